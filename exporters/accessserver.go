@@ -0,0 +1,111 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Path of the sacli command of OpenVPN Access Server, which queries its
+// XML-RPC interface.
+const defaultSacliPath = "/usr/local/openvpn_as/scripts/sacli"
+
+// Status of a single OpenVPN daemon of Access Server, as reported by
+// sacli VPNStatus: the contents of a version 3 status, with every table
+// as rows of fields.
+type accessServerDaemon struct {
+	Title        string              `json:"title"`
+	Time         []interface{}       `json:"time"`
+	Header       map[string][]string `json:"header"`
+	ClientList   [][]string          `json:"client_list"`
+	RoutingTable [][]string          `json:"routing_table"`
+}
+
+// Reads the status of OpenVPN Access Server, which doesn't write status
+// files, given as a sacli:[path] URL naming the sacli command, which
+// defaults to that of a standard installation. Returns the output of
+// sacli VPNStatus.
+func readAccessServerStatus(ctx context.Context, u *url.URL) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, managementTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, sacliCommand(u), "VPNStatus")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+// Returns the sacli command named by a sacli:[path] URL.
+func sacliCommand(u *url.URL) string {
+	if u.Path != "" {
+		return u.Path
+	} else if u.Opaque != "" {
+		return u.Opaque
+	}
+	return defaultSacliPath
+}
+
+// Converts the output of sacli VPNStatus into a version 3 status. Access
+// Server runs several OpenVPN daemons, whose statuses are merged into a
+// single one listing the clients of all of them.
+func accessServerStatus(output []byte) ([]byte, error) {
+	var daemons map[string]accessServerDaemon
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	// Keeps the UNIX timestamp from being formatted as a float.
+	decoder.UseNumber()
+	if err := decoder.Decode(&daemons); err != nil {
+		return nil, fmt.Errorf("parsing VPNStatus: %v", err)
+	}
+	names := make([]string, 0, len(daemons))
+	for name := range daemons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var status bytes.Buffer
+	// The title and time of the first daemon stand for all of them,
+	// as they run the same version and are queried at once.
+	if len(names) > 0 {
+		first := daemons[names[0]]
+		status.WriteString("TITLE\t" + first.Title + "\n")
+		if len(first.Time) == 2 {
+			fmt.Fprintf(&status, "TIME\t%v\t%v\n", first.Time[0], first.Time[1])
+		}
+	}
+	for _, table := range []struct {
+		header string
+		rows   func(accessServerDaemon) [][]string
+	}{
+		{"CLIENT_LIST", func(d accessServerDaemon) [][]string { return d.ClientList }},
+		{"ROUTING_TABLE", func(d accessServerDaemon) [][]string { return d.RoutingTable }},
+	} {
+		headerWritten := false
+		for _, name := range names {
+			daemon := daemons[name]
+			columns, ok := daemon.Header[table.header]
+			if !ok {
+				continue
+			}
+			if !headerWritten {
+				status.WriteString("HEADER\t" + table.header + "\t" + strings.Join(columns, "\t") + "\n")
+				headerWritten = true
+			}
+			for _, row := range table.rows(daemon) {
+				status.WriteString(table.header + "\t" + strings.Join(row, "\t") + "\n")
+			}
+		}
+	}
+	status.WriteString("END\n")
+	return status.Bytes(), nil
+}
@@ -0,0 +1,35 @@
+package exporters
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectAccessServer(t *testing.T) {
+	// Replaces sacli by a script printing the VPNStatus of two daemons.
+	status, err := filepath.Abs(filepath.Join("testdata", "accessserver.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sacli := filepath.Join(t.TempDir(), "sacli")
+	script := "#!/bin/sh\n[ \"$1\" = VPNStatus ] && exec cat " + shellQuote(status) + "\nexit 1\n"
+	if err := ioutil.WriteFile(sacli, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewOpenVPNExporter("sacli://"+sacli, Options{
+		GeoProvider: fakeGeoProvider{},
+		ServerName:  "accessserver",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, e, "accessserver.metrics")
+}
+
+func TestAccessServerStatusMalformed(t *testing.T) {
+	if _, err := accessServerStatus([]byte("Traceback (most recent call last):")); err == nil {
+		t.Error("expected an error for output that isn't JSON")
+	}
+}
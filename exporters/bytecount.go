@@ -0,0 +1,181 @@
+package exporters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delay before reconnecting to a management interface whose bytecount
+// notifications stopped.
+const bytecountRetryDelay = 10 * time.Second
+
+// Byte counts of a client as last notified by the management interface,
+// along with the rates since the notification before.
+type bandwidthSample struct {
+	received    float64
+	sent        float64
+	at          time.Time
+	receiveRate float64
+	sendRate    float64
+	hasRates    bool
+}
+
+// Keeps the bandwidth of the clients of a management interface, derived
+// from its bytecount notifications. Clients are keyed on client ID.
+type clientBandwidth struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	samples  map[string]bandwidthSample
+}
+
+func newClientBandwidth(interval time.Duration) *clientBandwidth {
+	return &clientBandwidth{interval: interval, samples: map[string]bandwidthSample{}}
+}
+
+// Records the byte counts of a client notified at the given time.
+// Clients that weren't notified for several intervals, as they
+// disconnected, are forgotten. Counters going down yield rates of zero.
+func (b *clientBandwidth) update(clientID string, received float64, sent float64, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sample := bandwidthSample{received: received, sent: sent, at: now}
+	previous, ok := b.samples[clientID]
+	if elapsed := now.Sub(previous.at).Seconds(); ok && elapsed > 0 {
+		sample.hasRates = true
+		if received >= previous.received && sent >= previous.sent {
+			sample.receiveRate = (received - previous.received) / elapsed
+			sample.sendRate = (sent - previous.sent) / elapsed
+		}
+	}
+	b.samples[clientID] = sample
+	for id, sample := range b.samples {
+		if now.Sub(sample.at) > 3*b.interval {
+			delete(b.samples, id)
+		}
+	}
+}
+
+// Returns the receive and send rates of a client in bytes per second,
+// if it was notified twice and recently enough.
+func (b *clientBandwidth) rates(clientID string, now time.Time) (float64, float64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sample, ok := b.samples[clientID]
+	if !ok || !sample.hasRates || now.Sub(sample.at) > 3*b.interval {
+		return 0, 0, false
+	}
+	return sample.receiveRate, sample.sendRate, true
+}
+
+// Forgets all clients, as their notifications stopped.
+func (b *clientBandwidth) reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.samples = map[string]bandwidthSample{}
+}
+
+// Keeps a connection to a management interface subscribed to bytecount
+// notifications, reconnecting after failures, until the context is
+// done, as when the exporter is closed or the source removed.
+func (e *OpenVPNExporter) watchBytecount(ctx context.Context, source *statusSource, u *url.URL) {
+	defer e.background.Done()
+	for {
+		err := e.readBytecount(ctx, source, u)
+		source.bandwidth.reset()
+		if ctx.Err() != nil {
+			return
+		}
+		e.logger.Warnf("Bytecount notifications of %s stopped: %v", source.Name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(bytecountRetryDelay):
+		}
+	}
+}
+
+// Subscribes to the bytecount notifications of a management interface
+// and records them until the connection fails or the context is done.
+func (e *OpenVPNExporter) readBytecount(ctx context.Context, source *statusSource, u *url.URL) error {
+	conn, reader, err := openManagement(ctx, u.Scheme, managementAddress(u), e.managementPassword(u))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	seconds := int(source.bandwidth.interval.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	if _, err := fmt.Fprintf(conn, "bytecount %d\n", seconds); err != nil {
+		return err
+	}
+	for {
+		// Notifications arrive every interval while clients are
+		// connected, so silence only means there are none.
+		if err := conn.SetDeadline(time.Now().Add(managementTimeout + 3*source.bandwidth.interval)); err != nil {
+			return err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				source.bandwidth.reset()
+				continue
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "ERROR:") {
+			return fmt.Errorf("management interface: %s", line)
+		}
+		// >BYTECOUNT_CLI:{CID},{BYTES_IN},{BYTES_OUT}, with bytes in
+		// being those the server received from the client.
+		if !strings.HasPrefix(line, ">BYTECOUNT_CLI:") {
+			continue
+		}
+		fields := strings.Split(strings.TrimPrefix(line, ">BYTECOUNT_CLI:"), ",")
+		if len(fields) != 3 {
+			continue
+		}
+		received, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		sent, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		source.bandwidth.update(fields[0], received, sent, time.Now())
+	}
+}
+
+// Adds the bandwidth of a CLIENT_LIST entry, notified by the management
+// interface, to its column values.
+func (e *OpenVPNExporter) collectClientBandwidth(source *statusSource, columnValues map[string]string) {
+	clientID, ok := columnValues["Client ID"]
+	if !ok {
+		return
+	}
+	if receiveRate, sendRate, ok := source.bandwidth.rates(clientID, time.Now()); ok {
+		columnValues["Bandwidth Received"] = fmt.Sprintf("%f", receiveRate)
+		columnValues["Bandwidth Sent"] = fmt.Sprintf("%f", sendRate)
+	}
+}
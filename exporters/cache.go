@@ -0,0 +1,202 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Remembers the metrics of the last successfully collected status file,
+// along with the modification time and size it had, or the validators
+// it was fetched over HTTP with, so that scrapes can skip parsing a file
+// that OpenVPN didn't rewrite since.
+type statusCache struct {
+	mutex      sync.Mutex
+	modTime    time.Time
+	size       int64
+	validators remoteValidators
+	updateTime time.Time
+	metrics    []prometheus.Metric
+	valid      bool
+}
+
+// Returns the cached metrics of a status file and the time its status
+// was updated, if the file is unchanged since they were collected.
+func (c *statusCache) load(statusPath string) ([]prometheus.Metric, time.Time, bool) {
+	info, err := os.Stat(statusPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, time.Time{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.valid || !info.ModTime().Equal(c.modTime) || info.Size() != c.size {
+		return nil, time.Time{}, false
+	}
+	return c.metrics, c.updateTime, true
+}
+
+// Returns the validators of the status fetched over HTTP whose metrics
+// are cached, if any.
+func (c *statusCache) remoteValidators() remoteValidators {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.valid {
+		return remoteValidators{}
+	}
+	return c.validators
+}
+
+// Returns the cached metrics of a status fetched over HTTP and the time
+// its status was updated, if they were collected from the status with
+// the given validators.
+func (c *statusCache) loadRemote(validators remoteValidators) ([]prometheus.Metric, time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.valid || validators == (remoteValidators{}) || c.validators != validators {
+		return nil, time.Time{}, false
+	}
+	return c.metrics, c.updateTime, true
+}
+
+// Replaces the cached metrics by those collected from a status file
+// with the given modification time and size.
+func (c *statusCache) store(info os.FileInfo, metrics []prometheus.Metric, updateTime time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+	c.validators = remoteValidators{}
+	c.metrics = metrics
+	c.updateTime = updateTime
+	c.valid = true
+}
+
+// Replaces the cached metrics by those collected from a status fetched
+// over HTTP with the given validators.
+func (c *statusCache) storeRemote(validators remoteValidators, metrics []prometheus.Metric, updateTime time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.modTime = time.Time{}
+	c.size = 0
+	c.validators = validators
+	c.metrics = metrics
+	c.updateTime = updateTime
+	c.valid = true
+}
+
+// Forgets the cached metrics, so that the next scrape parses the file.
+func (c *statusCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.valid = false
+	c.metrics = nil
+}
+
+// Collects the metrics of a status source, replaying the cached ones
+// when the status file didn't change since the previous scrape. Returns
+// whether the metrics came from the cache.
+func (e *OpenVPNExporter) collectStatusCached(ctx context.Context, source *statusSource, ch chan<- prometheus.Metric) (bool, error) {
+	if isRemoteStatus(source.Path) {
+		return e.collectRemoteStatusCached(ctx, source, ch)
+	}
+	if metrics, updateTime, ok := source.cache.load(source.Path); ok {
+		return true, e.replayCached(source, metrics, updateTime, ch)
+	}
+
+	// Stat before reading, so that a rewrite during the scrape
+	// invalidates the cached metrics on the next one.
+	info, statErr := os.Stat(source.Path)
+	metrics, err := teeMetrics(ch, func(tee chan<- prometheus.Metric) error {
+		return e.collectStatusFromFile(ctx, source, tee)
+	})
+	if err != nil || statErr != nil || !info.Mode().IsRegular() || e.geoResolutionPending() {
+		source.cache.invalidate()
+		return false, err
+	}
+	source.cache.store(info, metrics, e.statusUpdateTime(metrics))
+	return false, nil
+}
+
+// Collects the metrics of a status fetched over HTTP, asking the server
+// to only send it if it changed since it was cached, and replaying the
+// cached metrics otherwise.
+func (e *OpenVPNExporter) collectRemoteStatusCached(ctx context.Context, source *statusSource, ch chan<- prometheus.Metric) (bool, error) {
+	since := source.cache.remoteValidators()
+	status, validators, err := fetchRemoteStatus(ctx, source.Path, e.options.StatusBearerToken, since)
+	if err == errStatusNotModified {
+		if metrics, updateTime, ok := source.cache.loadRemote(validators); ok {
+			return true, e.replayCached(source, metrics, updateTime, ch)
+		}
+		// Invalidated by a concurrent scrape since.
+		status, validators, err = fetchRemoteStatus(ctx, source.Path, e.options.StatusBearerToken, remoteValidators{})
+	}
+	if err != nil {
+		source.cache.invalidate()
+		return false, &collectError{reason: "open", err: err}
+	}
+
+	metrics, err := teeMetrics(ch, func(tee chan<- prometheus.Metric) error {
+		return e.collectStatusFromStream(ctx, source, bytes.NewReader(status), tee)
+	})
+	if err != nil || validators == (remoteValidators{}) || e.geoResolutionPending() {
+		source.cache.invalidate()
+		return false, err
+	}
+	source.cache.storeRemote(validators, metrics, e.statusUpdateTime(metrics))
+	return false, nil
+}
+
+// Exports the cached metrics of a status, along with its current age.
+func (e *OpenVPNExporter) replayCached(source *statusSource, metrics []prometheus.Metric, updateTime time.Time, ch chan<- prometheus.Metric) error {
+	for _, metric := range metrics {
+		if desc := metric.Desc(); desc != e.openvpnStatusAgeDesc && desc != e.openvpnStatusStaleDesc {
+			ch <- metric
+		}
+	}
+	return e.collectStatusAge(source, updateTime, ch)
+}
+
+// Passes on the metrics sent by collect, returning them along with its
+// error.
+func teeMetrics(ch chan<- prometheus.Metric, collect func(chan<- prometheus.Metric) error) ([]prometheus.Metric, error) {
+	tee := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for metric := range tee {
+			metrics = append(metrics, metric)
+			ch <- metric
+		}
+		done <- metrics
+	}()
+	err := collect(tee)
+	close(tee)
+	return <-done, err
+}
+
+// Whether clients are still being resolved in the background, which are
+// exported with their geo labels once the status is parsed again.
+func (e *OpenVPNExporter) geoResolutionPending() bool {
+	e.geoPendingMutex.Lock()
+	defer e.geoPendingMutex.Unlock()
+	return len(e.geoPending) > 0
+}
+
+// Returns the status update time exported among the metrics, if any.
+func (e *OpenVPNExporter) statusUpdateTime(metrics []prometheus.Metric) time.Time {
+	for _, metric := range metrics {
+		if metric.Desc() != e.openvpnStatusUpdateTimeDesc {
+			continue
+		}
+		var m dto.Metric
+		if err := metric.Write(&m); err == nil {
+			return time.Unix(int64(m.GetGauge().GetValue()), 0)
+		}
+	}
+	return time.Time{}
+}
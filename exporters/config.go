@@ -0,0 +1,150 @@
+package exporters
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mmcloughlin/geohash"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file listing the servers to collect.
+type configFile struct {
+	Servers []configServer `yaml:"servers"`
+}
+
+// Server listed by a configuration file.
+type configServer struct {
+	Name       string            `yaml:"name"`
+	StatusPath string            `yaml:"status_path"`
+	Management string            `yaml:"management"`
+	Location   *configLocation   `yaml:"location"`
+	Labels     map[string]string `yaml:"labels"`
+	Timeout    string            `yaml:"timeout"`
+}
+
+// Manual location of a server.
+type configLocation struct {
+	Latitude  *float64 `yaml:"latitude"`
+	Longitude *float64 `yaml:"longitude"`
+	City      string   `yaml:"city"`
+	Country   string   `yaml:"country"`
+	Region    string   `yaml:"region"`
+	PublicIP  string   `yaml:"public_ip"`
+}
+
+// LoadConfig reads a YAML configuration file listing the servers to
+// collect, and returns a status source for each, such as:
+//
+//	servers:
+//	  - name: amsterdam
+//	    status_path: /var/log/openvpn/amsterdam.status
+//	    labels:
+//	      environment: production
+//	  - name: frankfurt
+//	    management: 10.0.0.2:7505
+//	    location:
+//	      latitude: 50.11
+//	      longitude: 8.68
+//	      city: Frankfurt
+//	      country: Germany
+//
+// Every server has a name, exported as the server_name label, and either
+// a status path, which may be any path the exporter collects, or the
+// address of a management interface, given as host:port or as the path
+// of a unix domain socket. The optional location replaces the one that
+// GeoIP resolves, and labels are exported as extra server labels, which
+// are empty for the servers that don't set them. A timeout, such as 5s,
+// overrides the one of the exporter's options.
+func LoadConfig(path string) ([]StatusSource, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := parseConfig(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sources, nil
+}
+
+func parseConfig(contents string) ([]StatusSource, error) {
+	var config configFile
+	decoder := yaml.NewDecoder(strings.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.New("expected a list of servers")
+	}
+	var sources []StatusSource
+	for i, server := range config.Servers {
+		source, err := parseConfigServer(server)
+		if err != nil {
+			return nil, fmt.Errorf("server %d: %v", i+1, err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func parseConfigServer(server configServer) (StatusSource, error) {
+	if server.Name == "" {
+		return StatusSource{}, errors.New("name is required")
+	}
+	source := StatusSource{Name: server.Name, Labels: server.Labels}
+	switch {
+	case server.StatusPath != "" && server.Management != "":
+		return StatusSource{}, fmt.Errorf("%s: status_path and management are mutually exclusive", source.Name)
+	case server.StatusPath != "":
+		source.Path = server.StatusPath
+	case strings.HasPrefix(server.Management, "/"):
+		source.Path = "unix://" + server.Management
+	case server.Management != "":
+		source.Path = "tcp://" + server.Management
+	default:
+		return StatusSource{}, fmt.Errorf("%s: status_path or management is required", source.Name)
+	}
+
+	if server.Timeout != "" {
+		var err error
+		if source.Timeout, err = time.ParseDuration(server.Timeout); err != nil || source.Timeout <= 0 {
+			return StatusSource{}, fmt.Errorf("%s: invalid timeout %q", source.Name, server.Timeout)
+		}
+	}
+	if server.Location != nil {
+		var err error
+		if source.Location, err = parseConfigLocation(*server.Location); err != nil {
+			return StatusSource{}, fmt.Errorf("%s: location: %v", source.Name, err)
+		}
+	}
+	return source, nil
+}
+
+// Converts the manual location of a server, which requires both
+// coordinates if either is given.
+func parseConfigLocation(location configLocation) (*GeoIP, error) {
+	geo := GeoIP{
+		City:        location.City,
+		CountryName: location.Country,
+		RegionName:  location.Region,
+		Ip:          location.PublicIP,
+	}
+	if location.Latitude == nil && location.Longitude == nil {
+		return &geo, nil
+	}
+	if location.Latitude == nil || location.Longitude == nil {
+		return nil, errors.New("latitude and longitude must be given together")
+	}
+	geo.Lat, geo.Lon = *location.Latitude, *location.Longitude
+	if !validCoordinates(geo.Lat, geo.Lon) {
+		return nil, fmt.Errorf("coordinates out of range: %v, %v", geo.Lat, geo.Lon)
+	}
+	geo.Geohash = geohash.Encode(geo.Lat, geo.Lon)
+	return &geo, nil
+}
@@ -0,0 +1,141 @@
+package exporters
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+# Servers collected by the exporter.
+servers:
+  - name: amsterdam
+    status_path: testdata/server2.status
+    labels:
+      environment: production
+      datacenter: "ams-1"  # quoted
+  - name: frankfurt
+    management: 10.0.0.2:7505
+    timeout: 5s
+    location:
+      latitude: 50.11
+      longitude: 8.68
+      city: Frankfurt
+      country: Germany
+  - name: local
+    management: /run/openvpn/server.sock
+    labels:
+      environment: 'staging'
+`
+
+func TestParseConfig(t *testing.T) {
+	sources, err := parseConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frankfurt := &GeoIP{City: "Frankfurt", CountryName: "Germany", Lat: 50.11, Lon: 8.68, Geohash: "u0yjjd0xftj1"}
+	expected := []StatusSource{
+		{Name: "amsterdam", Path: "testdata/server2.status", Labels: map[string]string{"environment": "production", "datacenter": "ams-1"}},
+		{Name: "frankfurt", Path: "tcp://10.0.0.2:7505", Location: frankfurt, Timeout: 5 * time.Second},
+		{Name: "local", Path: "unix:///run/openvpn/server.sock", Labels: map[string]string{"environment": "staging"}},
+	}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("expected %+v, got %+v", expected, sources)
+	}
+}
+
+func TestParseConfigFlowStyle(t *testing.T) {
+	sources, err := parseConfig(`servers: [{name: amsterdam, status_path: "testdata/server2.status", labels: {environment: production}}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []StatusSource{
+		{Name: "amsterdam", Path: "testdata/server2.status", Labels: map[string]string{"environment": "production"}},
+	}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("expected %+v, got %+v", expected, sources)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"",
+		"servers:\n",
+		"server:\n  - name: a\n    status_path: a.status\n",
+		"servers:\n  - status_path: a.status\n",
+		"servers:\n  - name: a\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    management: 127.0.0.1:7505\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    port: 1194\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    timeout: 5\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    location:\n      latitude: 52.37\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    location:\n      latitude: 95\n      longitude: 4.89\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    labels: [production]\n",
+		"servers:\n  - name: a\n     status_path: a.status\n",
+		"servers:\n\t- name: a\n",
+		"servers:\n  - name: a\n    status_path: a.status\n    location:\n      latitude: north\n      longitude: 4.89\n",
+	} {
+		if _, err := parseConfig(config); err == nil {
+			t.Errorf("expected an error parsing %q", config)
+		}
+	}
+}
+
+func TestConfigServerLabels(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yml")
+	contents := strings.Replace(testConfig, "testdata/server2.status", filepath.Join("testdata", "server2.status"), 1)
+	// Management interfaces aren't reachable in tests.
+	contents = contents[:strings.Index(contents, "  - name: frankfurt")] + `  - name: tcp
+    status_path: testdata/server3.status
+    location:
+      latitude: 50.11
+      longitude: 8.68
+      city: Frankfurt
+`
+	if err := os.WriteFile(config, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := LoadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewMultiOpenVPNExporter(sources, Options{DisableGeoIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.options.ServerLabels, []string{"datacenter", "environment"}) {
+		t.Errorf("expected the labels of the servers, got %v", e.options.ServerLabels)
+	}
+	values := map[string][]string{}
+	for _, source := range e.statusSources() {
+		values[source.Name] = e.serverLabelValues(source)
+	}
+	if expected := []string{"amsterdam", "", "", "", "", "", "ams-1", "production"}; !reflect.DeepEqual(values["amsterdam"], expected) {
+		t.Errorf("expected %v, got %v", expected, values["amsterdam"])
+	}
+	if expected := []string{"tcp", "u0yjj", "Frankfurt", "", "", "", "", ""}; !reflect.DeepEqual(values["tcp"], expected) {
+		t.Errorf("expected %v, got %v", expected, values["tcp"])
+	}
+	if count := gatherCount(t, e, "openvpn_server_connected_clients"); count != 2 {
+		t.Errorf("expected both servers to be collected, got %d", count)
+	}
+
+	// Labels can't be added by reloading, as they are part of every metric.
+	sources[0].Labels["team"] = "network"
+	if err := e.SetStatusSources(sources); err == nil {
+		t.Error("expected an error for an unknown server label")
+	}
+}
+
+func TestValidateServerLabels(t *testing.T) {
+	if err := validateServerLabels([]string{"environment", "datacenter"}); err != nil {
+		t.Error(err)
+	}
+	for _, names := range [][]string{{"server_name"}, {"country"}, {"environment", "environment"}, {"data-center"}, {"__name"}} {
+		if err := validateServerLabels(names); err == nil {
+			t.Errorf("expected an error for %v", names)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package exporters
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiscoverStatusSources reads the status directive of the OpenVPN
+// configuration files matching a glob pattern, such as
+// /etc/openvpn/server/*.conf, and returns a status source for each,
+// named after its configuration file without the extension.
+// Configuration files lacking a status directive are skipped.
+//
+// Relative status paths are resolved like OpenVPN does when started in
+// the directory of the configuration file, as systemd units do, taking
+// any cd directive into account.
+func DiscoverStatusSources(pattern string) ([]StatusSource, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var sources []StatusSource
+	for _, path := range paths {
+		statusPath, err := readStatusDirective(path)
+		if err != nil {
+			return nil, err
+		}
+		if statusPath == "" {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		sources = append(sources, StatusSource{Name: name, Path: statusPath})
+	}
+	return sources, nil
+}
+
+// Returns the status path configured by an OpenVPN configuration file,
+// or an empty string if it has no status directive.
+func readStatusDirective(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	dir := filepath.Dir(path)
+	statusPath := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := configDirective(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "cd":
+			if filepath.IsAbs(fields[1]) {
+				dir = fields[1]
+			} else {
+				dir = filepath.Join(dir, fields[1])
+			}
+		case "status":
+			statusPath = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	if statusPath != "" && !filepath.IsAbs(statusPath) {
+		statusPath = filepath.Join(dir, statusPath)
+	}
+	return statusPath, nil
+}
+
+// Splits a line of an OpenVPN configuration file into the directive and
+// its arguments, leaving out comments, which start with # or ;, and the
+// double quotes around arguments holding spaces.
+func configDirective(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for _, c := range strings.TrimSpace(line) {
+		switch {
+		case c == '"':
+			quoted, inField = !quoted, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		case !quoted && !inField && (c == '#' || c == ';'):
+			return fields
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
@@ -0,0 +1,37 @@
+package exporters
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverStatusSources(t *testing.T) {
+	dir := t.TempDir()
+	for name, config := range map[string]string{
+		"udp.conf": "port 1194\nproto udp\n# status /ignored.log\nstatus /run/openvpn/udp.status 10\n",
+		"tcp.conf": "proto tcp\ncd /etc/openvpn/tcp\nstatus \"status file.log\" ; relative to cd\n",
+		// Relative to the directory of the configuration file.
+		"relative.conf": "\tstatus relative.status\n",
+		"nostatus.conf": "proto udp\n",
+		"ignored.txt":   "status /run/openvpn/ignored.status\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sources, err := DiscoverStatusSources(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []StatusSource{
+		{Name: "relative", Path: filepath.Join(dir, "relative.status")},
+		{Name: "tcp", Path: "/etc/openvpn/tcp/status file.log"},
+		{Name: "udp", Path: "/run/openvpn/udp.status"},
+	}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("expected %+v, got %+v", expected, sources)
+	}
+}
@@ -0,0 +1,82 @@
+package exporters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Time a scrape waits for a writer to open a status FIFO and write a
+// complete status into it.
+const fifoTimeout = 10 * time.Second
+
+// Reads a complete status from a named pipe that OpenVPN, or a script
+// copying its status, writes into. Opening the pipe blocks until there
+// is a writer, and the status is complete once the writer closes the
+// pipe or writes the END footer, so that writers may also keep the pipe
+// open and write a status whenever one is read. Gives up once the fifo
+// timeout or the context's deadline passes.
+func readFIFOStatus(ctx context.Context, path string) ([]byte, error) {
+	deadline := time.Now().Add(fifoTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	opened := make(chan *os.File, 1)
+	openErr := make(chan error, 1)
+	go func() {
+		file, err := os.Open(path)
+		if err != nil {
+			openErr <- err
+			return
+		}
+		opened <- file
+	}()
+	var file *os.File
+	select {
+	case file = <-opened:
+	case err := <-openErr:
+		return nil, err
+	case <-ctx.Done():
+		// Unblock the pending open by briefly becoming its writer, which
+		// doesn't block as there is a reader.
+		if writer, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			writer.Close()
+		}
+		go func() {
+			select {
+			case file := <-opened:
+				file.Close()
+			case <-openErr:
+			}
+		}()
+		return nil, errors.New("timed out waiting for a writer to open the status FIFO")
+	}
+	defer file.Close()
+	if err := file.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var status bytes.Buffer
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		status.Write(line)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, errors.New("timed out reading a complete status from the FIFO")
+			}
+			// The writer closed the pipe.
+			return status.Bytes(), nil
+		}
+		if string(bytes.TrimRight(line, "\r\n")) == "END" {
+			return status.Bytes(), nil
+		}
+	}
+}
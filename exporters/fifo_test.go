@@ -0,0 +1,66 @@
+//go:build !windows
+
+package exporters
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Creates a FIFO into which a goroutine writes the status file whenever
+// it is opened, closing it afterwards unless keepOpen is set.
+func writeFIFO(t *testing.T, statusFile string, keepOpen bool) string {
+	t.Helper()
+	status, err := ioutil.ReadFile(filepath.Join("testdata", statusFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "status.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		for {
+			if _, err := file.Write(status); err != nil || !keepOpen {
+				return
+			}
+		}
+	}()
+	return path
+}
+
+func TestCollectFIFO(t *testing.T) {
+	for _, keepOpen := range []bool{false, true} {
+		path := writeFIFO(t, "server3.status", keepOpen)
+		e, err := NewOpenVPNExporter(path, Options{
+			GeoProvider: fakeGeoProvider{},
+			ServerName:  "testdata/server3.status",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareGolden(t, e, "server3.metrics")
+	}
+}
+
+func TestReadFIFOStatusTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := readFIFOStatus(ctx, path); err == nil {
+		t.Error("expected a timeout without a writer")
+	}
+}
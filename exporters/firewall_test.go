@@ -0,0 +1,62 @@
+package exporters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCollectFirewallStatus(t *testing.T) {
+	responses := map[string]string{
+		"/api/openvpn/service/search_sessions": `{"rows": [
+			{"type": "server", "id": "1", "description": "Road warriors", "common_name": "alice", "real_address": "198.51.100.23:50112", "virtual_address": "10.8.0.6", "virtual_ipv6_address": "", "bytes_received": "1851263", "bytes_sent": "2741904", "connected_since": "2023-05-11 15:02:44", "connected_since__time_t_": "1683817364", "username": "alice", "client_id": "0", "peer_id": "0", "cipher": "AES-256-GCM"},
+			{"type": "server", "id": "2", "description": "Idle", "common_name": null},
+			{"type": "client", "id": "3", "description": "Uplink", "common_name": "uplink"}
+		], "total": 3, "rowCount": 3, "current": 1}`,
+		"/api/v2/status/openvpn/servers": `{"code": 200, "status": "ok", "data": [
+			{"vpnid": 1, "name": "Road warriors", "conns": [
+				{"common_name": "alice", "remote_host": "198.51.100.23:50112", "virtual_addr": "10.8.0.6", "virtual_addr6": "", "bytes_recv": 1851263, "bytes_sent": 2741904, "connect_time": "Thu May 11 15:02:44 2023", "connect_time_unix": 1683817364, "user_name": "alice", "client_id": 0, "peer_id": 0, "cipher": "AES-256-GCM"}
+			]},
+			{"vpnid": 2, "name": "Idle", "conns": []}
+		]}`,
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "key" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+	original := statusHTTPClient
+	statusHTTPClient = server.Client()
+	defer func() { statusHTTPClient = original }()
+
+	for _, kind := range []string{"opnsense", "pfsense"} {
+		e, err := NewOpenVPNExporter(kind+"+"+strings.Replace(server.URL, "https://", "https://key:secret@", 1), Options{DisableGeoIP: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := gatherCount(t, e, "openvpn_server_client_received_bytes_total"); count != 1 {
+			t.Errorf("%s: expected a single client, got %d", kind, count)
+		}
+		for label, expected := range map[string]string{
+			"common_name":  "alice",
+			"real_address": "198.51.100.23:50112",
+			"client_id":    "0",
+		} {
+			if value := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", label); value != expected {
+				t.Errorf("%s: expected %s %q, got %q", kind, label, expected, value)
+			}
+		}
+		if name := gatherLabel(t, e, "openvpn_up", "server_name"); strings.Contains(name, "secret") {
+			t.Errorf("%s: expected the API secret to be redacted from %q", kind, name)
+		}
+	}
+}
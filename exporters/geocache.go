@@ -0,0 +1,146 @@
+package exporters
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Default age after which cached GeoIP data is looked up again.
+	defaultGeoCacheTTL = 7 * 24 * time.Hour
+	// Default maximum number of cached addresses.
+	defaultGeoCacheSize = 10000
+	// Interval at which newly resolved addresses are persisted.
+	geoCacheFlushInterval = time.Minute
+)
+
+// GeoIP data of an address as persisted, along with the time it was
+// resolved at.
+type persistedGeo struct {
+	Geo      GeoIP     `json:"geo"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// Persists the GeoIP cache to a JSON file, so that restarts don't have
+// to resolve every client again. Once writing fails, the cache is only
+// kept in memory.
+type geoCacheFile struct {
+	path   string
+	ttl    time.Duration
+	cache  *geoIPCache
+	logger Logger
+	mutex  sync.Mutex
+	// Time at which each persisted address was resolved, as last
+	// written.
+	resolved map[string]time.Time
+	written  bool
+	failed   bool
+}
+
+func newGeoCacheFile(path string, ttl time.Duration, cache *geoIPCache, logger Logger) *geoCacheFile {
+	return &geoCacheFile{path: path, ttl: ttl, cache: cache, logger: logger, resolved: map[string]time.Time{}}
+}
+
+// Loads the persisted GeoIP data into the cache, skipping entries older
+// than the TTL so that they are resolved again. A missing file is
+// treated as empty.
+func (f *geoCacheFile) load() {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		f.logger.Warnf("Error reading GeoIP cache file: %v", err)
+		return
+	}
+	var entries map[string]persistedGeo
+	if err := json.Unmarshal(data, &entries); err != nil {
+		f.logger.Warnf("Ignoring malformed GeoIP cache file: %v", err)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for address, entry := range entries {
+		if time.Since(entry.Resolved) > f.ttl {
+			continue
+		}
+		f.cache.setResolved(address, entry.Geo, entry.Resolved)
+		f.resolved[address] = entry.Resolved
+	}
+	f.logger.Debugf("Loaded %d cached GeoIP entries from %s", len(f.resolved), f.path)
+}
+
+// Writes the cache to the file if addresses were resolved since the
+// previous flush. The file is replaced atomically, so that a crash
+// while writing leaves the previous version.
+func (f *geoCacheFile) flush() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failed {
+		return
+	}
+	entries := f.cache.snapshot()
+	// Addresses were resolved, expired or evicted since the last write.
+	changed := !f.written || len(entries) != len(f.resolved)
+	for address, entry := range entries {
+		if resolved, ok := f.resolved[address]; !ok || !resolved.Equal(entry.Resolved) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := writeFileAtomically(f.path, entries); err != nil {
+		f.failed = true
+		f.logger.Warnf("Error writing GeoIP cache file, keeping the cache in memory only: %v", err)
+		return
+	}
+	f.resolved = map[string]time.Time{}
+	for address, entry := range entries {
+		f.resolved[address] = entry.Resolved
+	}
+	f.written = true
+}
+
+// Writes a value as JSON to a temporary file next to the path, then
+// renames it over the path.
+func writeFileAtomically(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Persists the GeoIP cache periodically until the exporter is closed,
+// and once more then.
+func (e *OpenVPNExporter) flushGeoCachePeriodically() {
+	defer e.background.Done()
+	ticker := time.NewTicker(geoCacheFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.backgroundCtx.Done():
+			e.geoCacheFile.flush()
+			return
+		case <-ticker.C:
+			e.geoCacheFile.flush()
+		}
+	}
+}
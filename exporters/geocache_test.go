@@ -0,0 +1,101 @@
+package exporters
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGeoCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.json")
+	e := newTestExporter(t, "server2.status", Options{GeoCacheFile: path})
+	compareGolden(t, e, "server2.metrics")
+	e.Close()
+
+	// After a restart, clients are resolved from the file.
+	e = newTestExporter(t, "server2.status", Options{GeoCacheFile: path, GeoProvider: serverOnlyGeoProvider{}})
+	defer e.Close()
+	compareGolden(t, e, "server2.metrics")
+	if misses := testutil.ToFloat64(e.geoIPCacheMisses); misses != 0 {
+		t.Errorf("expected no cache misses, got %v", misses)
+	}
+}
+
+func TestGeoCacheFileTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.json")
+	entries := map[string]persistedGeo{
+		"0.0.0.0": {Geo: GeoIP{Ip: "0.0.0.0", CountryName: "Belgium"}, Resolved: time.Now().Add(-2 * time.Hour)},
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExporter(t, "server2.status", Options{GeoCacheFile: path, GeoCacheTTL: time.Hour})
+	defer e.Close()
+	// The stale entry is resolved again.
+	if country := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "country"); country != "Netherlands" {
+		t.Errorf("expected the stale entry to be resolved again, got %q", country)
+	}
+}
+
+func TestGeoCacheFileUnwritable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "geoip.json")
+	e := newTestExporter(t, "server2.status", Options{GeoCacheFile: path})
+	defer e.Close()
+	compareGolden(t, e, "server2.metrics")
+	if !e.geoCacheFile.failed {
+		t.Error("expected persisting the cache to be given up")
+	}
+}
+
+// GeoProvider only resolving the server, failing for clients.
+type serverOnlyGeoProvider struct{}
+
+func (serverOnlyGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	if len(addresses) == 1 && addresses[0] == "" {
+		return fakeGeoProvider{}.Lookup(ctx, addresses)
+	}
+	return failingGeoProvider{}.Lookup(ctx, addresses)
+}
+
+func TestGeoIPCacheExpiresEntries(t *testing.T) {
+	c := newGeoIPCache(time.Hour, 0)
+	c.setResolved("198.51.100.1", GeoIP{City: "Amsterdam"}, time.Now().Add(-2*time.Hour))
+	c.set("198.51.100.2", GeoIP{City: "Utrecht"})
+	if _, ok := c.get("198.51.100.1"); ok {
+		t.Error("expected the entry resolved before the TTL to expire")
+	}
+	if geo, ok := c.get("198.51.100.2"); !ok || geo.City != "Utrecht" {
+		t.Errorf("expected the recent entry to be cached, got %+v", geo)
+	}
+	if entries := c.snapshot(); len(entries) != 1 {
+		t.Errorf("expected only the recent entry to be persisted, got %v", entries)
+	}
+}
+
+func TestGeoIPCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{GeoCacheSize: 2})
+	e.Close()
+	c := e.geoCache
+	c.set("198.51.100.1", GeoIP{})
+	c.set("198.51.100.2", GeoIP{})
+	// Using the first entry leaves the second one least recently used.
+	c.get("198.51.100.1")
+	c.set("198.51.100.3", GeoIP{})
+	for address, cached := range map[string]bool{"198.51.100.1": true, "198.51.100.2": false, "198.51.100.3": true} {
+		if _, ok := c.get(address); ok != cached {
+			t.Errorf("expected %s to be cached: %v", address, cached)
+		}
+	}
+	if evictions := testutil.ToFloat64(e.geoIPCacheEvictions); evictions != 1 {
+		t.Errorf("expected 1 eviction, got %v", evictions)
+	}
+}
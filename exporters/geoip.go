@@ -0,0 +1,366 @@
+package exporters
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/geohash"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GeoIP holds the location of an IP address.
+type GeoIP struct {
+	Ip          string
+	CountryName string
+	RegionName  string
+	City        string
+	Lat         float64
+	Lon         float64
+	Geohash     string
+}
+
+const (
+	// Default number of characters of geohash labels, identifying an
+	// area of about 5 by 5 kilometers.
+	defaultGeohashPrecision = 5
+	// Number of characters of a full precision geohash.
+	maxGeohashPrecision = 12
+)
+
+// Whether coordinates are within range. The zero pair, off the coast of
+// Africa, is what GeoIP APIs return for addresses they can't locate.
+func validCoordinates(lat float64, lon float64) bool {
+	if lat == 0 && lon == 0 {
+		return false
+	}
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// Returns the geohash of a location at the configured precision, or an
+// empty string if it wasn't resolved or its coordinates are invalid.
+func (e *OpenVPNExporter) geohash(geo GeoIP) string {
+	if geo.Geohash == "" || !validCoordinates(geo.Lat, geo.Lon) {
+		return ""
+	}
+	return geohash.EncodeWithPrecision(geo.Lat, geo.Lon, uint(e.options.GeohashPrecision))
+}
+
+// Address ranges that GeoIP APIs can't locate by default: private,
+// shared (CGNAT), loopback and link-local addresses.
+var defaultGeoIPExcludedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// Whether an address is in one of the ranges excluded from GeoIP
+// lookups.
+func (e *OpenVPNExporter) excludedFromGeo(address string) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range e.options.GeoIPExcludedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cache of the GeoIP data of client addresses, owned by an exporter.
+// Entries expire after a TTL, so that addresses that moved are resolved
+// again, and once the cache is full the least recently used entry is
+// evicted. It is safe for concurrent use, as scrapes may run
+// concurrently.
+type geoIPCache struct {
+	ttl  time.Duration
+	size int
+	// Evicted entries are counted, unless nil.
+	evictions prometheus.Counter
+	mutex     sync.Mutex
+	entries   map[string]*list.Element
+	// Entries from the most to the least recently used.
+	recency *list.List
+}
+
+type geoIPCacheEntry struct {
+	address  string
+	geo      GeoIP
+	resolved time.Time
+}
+
+// Returns a cache whose entries expire after the TTL, holding at most
+// size entries. Zero or a negative value disables either limit.
+func newGeoIPCache(ttl time.Duration, size int) *geoIPCache {
+	return &geoIPCache{ttl: ttl, size: size, entries: map[string]*list.Element{}, recency: list.New()}
+}
+
+// Returns the cached GeoIP data of an address, unless it expired.
+func (c *geoIPCache) get(address string) (GeoIP, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[address]
+	if !ok {
+		return GeoIP{}, false
+	}
+	entry := element.Value.(*geoIPCacheEntry)
+	if c.expired(entry.resolved) {
+		c.remove(element)
+		return GeoIP{}, false
+	}
+	c.recency.MoveToFront(element)
+	return entry.geo, true
+}
+
+// Caches the GeoIP data of an address resolved now.
+func (c *geoIPCache) set(address string, geo GeoIP) {
+	c.setResolved(address, geo, time.Now())
+}
+
+// Caches the GeoIP data of an address resolved at the given time,
+// evicting the least recently used entry if the cache is full.
+func (c *geoIPCache) setResolved(address string, geo GeoIP, resolved time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[address]; ok {
+		element.Value = &geoIPCacheEntry{address: address, geo: geo, resolved: resolved}
+		c.recency.MoveToFront(element)
+		return
+	}
+	c.entries[address] = c.recency.PushFront(&geoIPCacheEntry{address: address, geo: geo, resolved: resolved})
+	if c.size > 0 && c.recency.Len() > c.size {
+		c.remove(c.recency.Back())
+		if c.evictions != nil {
+			c.evictions.Inc()
+		}
+	}
+}
+
+// Returns a copy of the unexpired entries, indexed by address.
+func (c *geoIPCache) snapshot() map[string]persistedGeo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entries := make(map[string]persistedGeo, len(c.entries))
+	for address, element := range c.entries {
+		entry := element.Value.(*geoIPCacheEntry)
+		if !c.expired(entry.resolved) {
+			entries[address] = persistedGeo{Geo: entry.geo, Resolved: entry.resolved}
+		}
+	}
+	return entries
+}
+
+func (c *geoIPCache) expired(resolved time.Time) bool {
+	return c.ttl > 0 && time.Since(resolved) > c.ttl
+}
+
+func (c *geoIPCache) remove(element *list.Element) {
+	c.recency.Remove(element)
+	delete(c.entries, element.Value.(*geoIPCacheEntry).address)
+}
+
+// Number of batches of addresses that can await asynchronous resolution.
+const geoQueueSize = 64
+
+// Resolves the GeoIP data of the given addresses that aren't cached
+// yet. Failures are logged, leaving the affected addresses unresolved.
+func (e *OpenVPNExporter) resolveGeo(ctx context.Context, addresses []string) {
+	start := time.Now()
+	defer func() { e.geoIPResolutionDuration.Observe(time.Since(start).Seconds()) }()
+	var missing []string
+	seen := map[string]bool{}
+	for _, address := range addresses {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		if _, ok := e.geoCache.get(address); ok {
+			e.geoIPCacheHits.Inc()
+		} else {
+			e.geoIPCacheMisses.Inc()
+			missing = append(missing, address)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	if e.geoQueue != nil {
+		e.enqueueGeo(missing)
+		return
+	}
+	e.lookupGeo(ctx, missing)
+}
+
+// Looks up and caches the GeoIP data of the given addresses.
+func (e *OpenVPNExporter) lookupGeo(ctx context.Context, addresses []string) {
+	geos, err := e.geoProvider.Lookup(ctx, addresses)
+	// Addresses left unresolved by the rate limit are looked up again by
+	// a later scrape, as they aren't cached.
+	deferred := errors.Is(err, errGeoRateLimited)
+	if deferred {
+		e.logger.Debugf("Deferring %d GeoIP lookups: %v", len(addresses)-len(geos), err)
+	} else if err != nil {
+		e.logger.Warnf("Error resolving GeoIP: %v", err)
+	}
+	for _, address := range addresses {
+		if geo, ok := geos[address]; ok {
+			e.geoCache.set(address, geo)
+		} else if deferred {
+			e.geoIPLookupsDeferred.Inc()
+		} else {
+			e.geoIPLookupFailures.Inc()
+			e.logger.Debugf("No GeoIP data for %s", address)
+		}
+	}
+}
+
+// Queues addresses for resolution in the background, skipping those
+// already queued. When the queue is full, the addresses are left to be
+// queued again by a later scrape.
+func (e *OpenVPNExporter) enqueueGeo(addresses []string) {
+	e.geoPendingMutex.Lock()
+	defer e.geoPendingMutex.Unlock()
+	var queued []string
+	for _, address := range addresses {
+		if !e.geoPending[address] {
+			queued = append(queued, address)
+		}
+	}
+	if len(queued) == 0 {
+		return
+	}
+	select {
+	case e.geoQueue <- queued:
+		for _, address := range queued {
+			e.geoPending[address] = true
+		}
+	default:
+		e.logger.Debugf("GeoIP queue full, deferring %d addresses", len(queued))
+	}
+}
+
+// Resolves queued addresses in the background, until the exporter is
+// closed.
+func (e *OpenVPNExporter) resolveQueuedGeo() {
+	defer e.background.Done()
+	for {
+		select {
+		case <-e.backgroundCtx.Done():
+			return
+		case addresses := <-e.geoQueue:
+			e.lookupGeo(e.backgroundCtx, addresses)
+			e.geoPendingMutex.Lock()
+			for _, address := range addresses {
+				delete(e.geoPending, address)
+			}
+			e.geoPendingMutex.Unlock()
+		}
+	}
+}
+
+// Returns the GeoIP data of the server.
+func (e *OpenVPNExporter) serverGeo() GeoIP {
+	e.geoIPMutex.RLock()
+	defer e.geoIPMutex.RUnlock()
+	return e.geoIP
+}
+
+// Looks up the GeoIP data of the server's public IP, which is the
+// configured server address or else the address the GeoIP API sees the
+// exporter connect from. The cache is bypassed, so that changes of the
+// address are picked up. On failure the previous data is kept.
+func (e *OpenVPNExporter) refreshServerGeo() {
+	address, err := e.serverAddress(e.backgroundCtx)
+	if err != nil {
+		e.geoIPLookupFailures.Inc()
+		e.logger.Warnf("Error resolving server address: %v", err)
+		return
+	}
+	geos, err := e.geoProvider.Lookup(e.backgroundCtx, []string{address})
+	geo, ok := geos[address]
+	if !ok {
+		e.geoIPLookupFailures.Inc()
+		e.logger.Warnf("Error getting server geo: %v", err)
+		return
+	}
+	e.geoIPMutex.Lock()
+	e.geoIP = geo
+	e.geoIPMutex.Unlock()
+}
+
+// Returns the IP of the configured server address, resolving it if it
+// is a hostname, or an empty address to look up the exporter's own.
+func (e *OpenVPNExporter) serverAddress(ctx context.Context) (string, error) {
+	address := e.options.ServerAddress
+	if address == "" || net.ParseIP(address) != nil {
+		return address, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	return ips[0].IP.String(), nil
+}
+
+// Refreshes the server's GeoIP data at the given interval, until the
+// exporter is closed.
+func (e *OpenVPNExporter) refreshServerGeoPeriodically(interval time.Duration) {
+	defer e.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.backgroundCtx.Done():
+			return
+		case <-ticker.C:
+			e.refreshServerGeo()
+		}
+	}
+}
+
+// Close stops the background GeoIP lookups of the exporter, waiting for
+// those in progress to be cancelled. Metrics collected afterwards lack
+// the GeoIP data of clients that were still queued.
+func (e *OpenVPNExporter) Close() {
+	e.stopBackground()
+	e.background.Wait()
+}
+
+// Lengths of the supported distance units, in meters.
+var distanceUnits = map[string]float64{
+	"meters":     1,
+	"kilometers": 1000,
+	"miles":      1609.344,
+}
+
+func hsin(theta float64) float64 {
+	return math.Pow(math.Sin(theta/2), 2)
+}
+
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	var la1, lo1, la2, lo2, r float64
+	la1 = lat1 * math.Pi / 180
+	lo1 = lon1 * math.Pi / 180
+	la2 = lat2 * math.Pi / 180
+	lo2 = lon2 * math.Pi / 180
+
+	r = 6378100 // Earth radius in METERS
+
+	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
+
+	return 2 * r * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,620 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mmcloughlin/geohash"
+	"golang.org/x/time/rate"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GeoProvider resolves the location of IP addresses.
+type GeoProvider interface {
+	// Lookup returns the GeoIP data of the given addresses, indexed by
+	// address. Addresses that couldn't be resolved are missing from the
+	// result, along with an error if a lookup failed. An empty address
+	// stands for the caller's own public address.
+	Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error)
+}
+
+const (
+	// Default timeout of GeoIP lookups.
+	defaultGeoIPTimeout = 5 * time.Second
+	// Default number of GeoIP lookups per minute, matching the limit
+	// of ip-api.com's free endpoint.
+	defaultGeoIPRateLimit = 45
+	// Default GeoIP API, of which {ip} is replaced by the address.
+	defaultGeoIPURL = "http://ip-api.com/json/{ip}"
+	// Batch endpoint of the default GeoIP API.
+	defaultGeoIPBatchURL = "http://ip-api.com/batch"
+	// ip-api.com's paid endpoint, which supports HTTPS and isn't rate
+	// limited, authenticated by a key query parameter.
+	ipapiProURL = "https://pro.ip-api.com/"
+	// ipinfo.io's API, of which {ip} is replaced by the address.
+	ipinfoURL = "https://ipinfo.io/{ip}/json"
+	// ipinfo.io's API returning the caller's own address.
+	ipinfoSelfURL = "https://ipinfo.io/json"
+	// ipstack.com's API, of which {ip} is replaced by the address and
+	// {key} by the access key. Its free plan doesn't support HTTPS.
+	ipstackURL = "http://api.ipstack.com/{ip}?access_key={key}"
+	// Number of batch GeoIP lookups per minute, matching the limit of
+	// ip-api.com's free batch endpoint.
+	geoIPBatchRateLimit = 15
+	// Maximum number of addresses per batch GeoIP lookup.
+	geoIPBatchSize = 100
+	// Default number of retries of failed GeoIP requests.
+	defaultGeoIPRetries = 2
+	// Default delay before the first retry of a failed GeoIP request,
+	// which doubles with every further retry.
+	defaultGeoIPRetryBackoff = 500 * time.Millisecond
+)
+
+// Error of GeoIP lookups that the rate limit doesn't allow before they
+// time out.
+var errGeoRateLimited = errors.New("GeoIP rate limit exceeded")
+
+// Names of the fields of the default GeoIP API's JSON response, indexed
+// by the GeoIP field they are stored in. The coordinates field, which
+// the default API lacks, holds both coordinates as "lat,lon".
+var defaultGeoIPFields = map[string]string{
+	"ip":          "query",
+	"country":     "country",
+	"region":      "regionName",
+	"city":        "city",
+	"lat":         "lat",
+	"lon":         "lon",
+	"coordinates": "",
+}
+
+// Returns the default GeoIP response field names, overridden by the
+// given ones.
+func mergeGeoIPFields(fields map[string]string) (map[string]string, error) {
+	merged := map[string]string{}
+	for field, name := range defaultGeoIPFields {
+		merged[field] = name
+	}
+	for field, name := range fields {
+		if _, ok := defaultGeoIPFields[field]; !ok {
+			return nil, fmt.Errorf("unknown GeoIP field: %q", field)
+		}
+		merged[field] = name
+	}
+	return merged, nil
+}
+
+// Names of the fields of ipinfo.io's JSON response. Its country is a
+// two-letter code, and its coordinates are combined in a single field.
+var ipinfoGeoIPFields = map[string]string{
+	"ip":          "ip",
+	"country":     "country",
+	"region":      "region",
+	"city":        "city",
+	"lat":         "",
+	"lon":         "",
+	"coordinates": "loc",
+}
+
+// Names of the fields of ipstack.com's JSON response.
+var ipstackGeoIPFields = map[string]string{
+	"ip":          "ip",
+	"country":     "country_name",
+	"region":      "region_name",
+	"city":        "city",
+	"lat":         "latitude",
+	"lon":         "longitude",
+	"coordinates": "",
+}
+
+// Returns a limiter allowing the given number of GeoIP lookups per
+// minute. A negative number disables rate limiting.
+func newGeoLimiter(perMinute float64) *rate.Limiter {
+	if perMinute < 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perMinute/60), 1)
+}
+
+// Returns a limiter for batch GeoIP lookups, which are limited more
+// strictly than single ones. Rate limiting is disabled along with the
+// one of single lookups.
+func newGeoBatchLimiter(perMinute float64) *rate.Limiter {
+	if perMinute < 0 {
+		return newGeoLimiter(perMinute)
+	}
+	return newGeoLimiter(geoIPBatchRateLimit)
+}
+
+// GeoProvider querying a JSON GeoIP API over HTTP, ip-api.com by
+// default.
+type apiGeoProvider struct {
+	url string
+	// URL looking up the provider's own address, if it differs from url
+	// without an address.
+	selfURL string
+	// URL of the batch endpoint, which is only used if set.
+	batchURL     string
+	header       http.Header
+	fields       map[string]string
+	timeout      time.Duration
+	client       *http.Client
+	limiter      *rate.Limiter
+	batchLimiter *rate.Limiter
+	retries      int
+	retryBackoff time.Duration
+	logger       Logger
+}
+
+// Returns a GeoProvider for the GeoIP API configured in the options.
+func newAPIGeoProvider(options Options) (*apiGeoProvider, error) {
+	fields, err := mergeGeoIPFields(options.GeoIPFields)
+	if err != nil {
+		return nil, err
+	}
+	p := &apiGeoProvider{
+		url:          strings.ReplaceAll(options.GeoIPURL, "{key}", url.QueryEscape(options.GeoIPToken)),
+		header:       http.Header{},
+		fields:       fields,
+		timeout:      options.GeoIPTimeout,
+		client:       &http.Client{Timeout: options.GeoIPTimeout},
+		limiter:      newGeoLimiter(options.GeoIPRateLimit),
+		batchLimiter: newGeoBatchLimiter(options.GeoIPRateLimit),
+		retries:      options.GeoIPRetries,
+		retryBackoff: options.GeoIPRetryBackoff,
+		logger:       options.Logger,
+	}
+	if p.url == defaultGeoIPURL {
+		p.batchURL = defaultGeoIPBatchURL
+	} else if isIPAPIPro(p.url) {
+		// The batch endpoint takes the same key, and is limited like
+		// single lookups.
+		p.batchURL = ipapiProURL + "batch"
+		if i := strings.Index(p.url, "?"); i >= 0 {
+			p.batchURL += p.url[i:]
+		}
+		p.batchLimiter = newGeoLimiter(options.GeoIPRateLimit)
+	}
+	return p, nil
+}
+
+// Whether a GeoIP API URL is the one of ip-api.com's paid endpoint.
+func isIPAPIPro(url string) bool {
+	return strings.HasPrefix(url, ipapiProURL+"json/")
+}
+
+// Returns a GeoProvider querying ipinfo.io over HTTPS, authenticated by
+// the options' GeoIPToken unless it is empty, which is limited to
+// ipinfo.io's free tier.
+func newIPInfoGeoProvider(options Options) (*apiGeoProvider, error) {
+	p, err := newAPIGeoProvider(options)
+	if err != nil {
+		return nil, err
+	}
+	p.url = ipinfoURL
+	p.selfURL = ipinfoSelfURL
+	p.batchURL = ""
+	p.fields = ipinfoGeoIPFields
+	if options.GeoIPToken != "" {
+		p.header.Set("Authorization", "Bearer "+options.GeoIPToken)
+	}
+	return p, nil
+}
+
+// Returns a GeoProvider querying ipstack.com with the access key in the
+// options' GeoIPToken, which it requires.
+func newIPStackGeoProvider(options Options) (*apiGeoProvider, error) {
+	if options.GeoIPToken == "" {
+		return nil, errors.New("the ipstack GeoIP provider requires an access key")
+	}
+	p, err := newAPIGeoProvider(options)
+	if err != nil {
+		return nil, err
+	}
+	p.url = strings.ReplaceAll(ipstackURL, "{key}", url.QueryEscape(options.GeoIPToken))
+	// ipstack.com looks up the caller's own address at "check".
+	p.selfURL = strings.ReplaceAll(p.url, "{ip}", "check")
+	p.batchURL = ""
+	p.fields = ipstackGeoIPFields
+	return p, nil
+}
+
+// Lookup resolves the addresses in batches of up to geoIPBatchSize
+// addresses. GeoIP APIs without a batch endpoint, and the provider's own
+// address, are queried one address at a time. Once the rate limit is
+// exceeded, the remaining addresses are left unresolved, along with
+// errGeoRateLimited.
+func (p *apiGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	geos := map[string]GeoIP{}
+	var batchable []string
+	var lastErr error
+	for _, address := range addresses {
+		if p.batchURL != "" && address != "" {
+			batchable = append(batchable, address)
+			continue
+		}
+		if errors.Is(lastErr, errGeoRateLimited) {
+			continue
+		}
+		geo, err := p.fetchGeo(ctx, address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		geos[address] = geo
+	}
+
+	for len(batchable) > 0 {
+		batch := batchable
+		if len(batch) > geoIPBatchSize {
+			batch = batch[:geoIPBatchSize]
+		}
+		batchable = batchable[len(batch):]
+		if errors.Is(lastErr, errGeoRateLimited) {
+			continue
+		}
+
+		batchGeos, err := p.fetchGeoBatch(ctx, batch)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for address, geo := range batchGeos {
+			geos[address] = geo
+		}
+	}
+	return geos, lastErr
+}
+
+// Looks up the GeoIP data of several addresses in a single request to
+// ip-api.com's batch endpoint. Returns the data of the addresses that
+// could be resolved.
+func (p *apiGeoProvider) fetchGeoBatch(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	p.logger.Debugf("Resolving %d addresses", len(addresses))
+
+	query, err := json.Marshal(addresses)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.fetch(ctx, p.batchLimiter, http.MethodPost, p.batchURL, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, fmt.Errorf("GeoIP response is not a JSON array: %v", err)
+	}
+
+	if len(results) != len(addresses) {
+		return nil, fmt.Errorf("GeoIP response holds %d results for %d addresses", len(results), len(addresses))
+	}
+
+	// Results are in the order of the queried addresses.
+	geos := map[string]GeoIP{}
+	for i, result := range results {
+		if result["status"] != "success" {
+			continue
+		}
+		geo, err := p.decodeGeo(result)
+		if err != nil {
+			return nil, err
+		}
+		geos[addresses[i]] = geo
+	}
+	return geos, nil
+}
+
+// Looks up the GeoIP data of an address at the configured GeoIP API.
+// The lookup is abandoned when the context is done.
+func (p *apiGeoProvider) fetchGeo(ctx context.Context, address string) (GeoIP, error) {
+	p.logger.Debugf("Resolving %s", address)
+
+	requestURL := strings.ReplaceAll(p.url, "{ip}", address)
+	if address == "" && p.selfURL != "" {
+		requestURL = p.selfURL
+	}
+	body, err := p.fetch(ctx, p.limiter, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return GeoIP{}, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return GeoIP{}, fmt.Errorf("GeoIP response is not a JSON object: %v", err)
+	}
+	// Some APIs, such as ipstack.com, report errors in successful
+	// responses, as in {"success": false, "error": {"info": "..."}}.
+	if fields["success"] == false {
+		details, _ := fields["error"].(map[string]interface{})
+		info, _ := details["info"].(string)
+		return GeoIP{}, fmt.Errorf("GeoIP API returned an error: %s", info)
+	}
+	return p.decodeGeo(fields)
+}
+
+// Error of a GeoIP request that may succeed when retried, optionally
+// after the delay requested by the API.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Sends a request to the GeoIP API, with a JSON body unless it is nil,
+// and returns the body of the response. Network errors and responses
+// indicating a server error or rate limiting are retried with
+// exponential backoff, for as long as the context permits.
+func (p *apiGeoProvider) fetch(ctx context.Context, limiter *rate.Limiter, method string, url string, body []byte) ([]byte, error) {
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		response, err := p.fetchOnce(ctx, limiter, method, url, body)
+		var retryable *retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt >= p.retries || ctx.Err() != nil {
+			return response, err
+		}
+
+		delay := backoff
+		if retryable.retryAfter > delay {
+			delay = retryable.retryAfter
+		}
+		p.logger.Debugf("Retrying GeoIP request in %s: %v", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Sends a single request to the GeoIP API, see fetch.
+func (p *apiGeoProvider) fetchOnce(ctx context.Context, limiter *rate.Limiter, method string, url string, body []byte) ([]byte, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != nil {
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", errGeoRateLimited, err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range p.header {
+		request.Header[name] = values
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return nil, &retryableError{
+			err:        fmt.Errorf("unexpected GeoIP response status: %s", response.Status),
+			retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
+	} else if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected GeoIP response status: %s", response.Status)
+	}
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+	return responseBody, nil
+}
+
+// Parses a Retry-After header, which holds either a number of seconds
+// or a date. Returns zero if the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Extracts the GeoIP data from the fields of a JSON response, using the
+// configured field names. Fields missing from the response are left
+// empty, but a response lacking all of them or holding values of the
+// wrong type doesn't match the expected schema.
+func (p *apiGeoProvider) decodeGeo(fields map[string]interface{}) (GeoIP, error) {
+	geo := GeoIP{}
+	found := false
+	for field, target := range map[string]*string{
+		"ip":      &geo.Ip,
+		"country": &geo.CountryName,
+		"region":  &geo.RegionName,
+		"city":    &geo.City,
+	} {
+		name := p.fields[field]
+		if value, ok := fields[name]; ok {
+			str, ok := value.(string)
+			if !ok {
+				return GeoIP{}, fmt.Errorf("GeoIP response field %q holds %T instead of a string", name, value)
+			}
+			*target = str
+			found = true
+		}
+	}
+	for field, target := range map[string]*float64{
+		"lat": &geo.Lat,
+		"lon": &geo.Lon,
+	} {
+		name := p.fields[field]
+		if value, ok := fields[name]; ok {
+			// Some APIs return coordinates as strings.
+			var err error
+			switch v := value.(type) {
+			case float64:
+				*target = v
+			case string:
+				*target, err = strconv.ParseFloat(v, 64)
+			default:
+				err = fmt.Errorf("%T is not a number", value)
+			}
+			if err != nil {
+				return GeoIP{}, fmt.Errorf("GeoIP response field %q holds no coordinate: %v", name, err)
+			}
+			found = true
+		}
+	}
+	if name := p.fields["coordinates"]; name != "" && fields[name] != nil {
+		value, _ := fields[name].(string)
+		lat, lon, ok := strings.Cut(value, ",")
+		var err error
+		if ok {
+			if geo.Lat, err = strconv.ParseFloat(strings.TrimSpace(lat), 64); err == nil {
+				geo.Lon, err = strconv.ParseFloat(strings.TrimSpace(lon), 64)
+			}
+		}
+		if !ok || err != nil {
+			return GeoIP{}, fmt.Errorf("GeoIP response field %q holds no coordinates: %q", name, value)
+		}
+		found = true
+	}
+	if !found {
+		return GeoIP{}, fmt.Errorf("GeoIP response has none of the expected fields, check the field mapping")
+	}
+
+	if validCoordinates(geo.Lat, geo.Lon) {
+		geo.Geohash = geohash.Encode(geo.Lat, geo.Lon)
+	}
+	return geo, nil
+}
+
+// GeoProvider resolving nothing, leaving geo labels empty.
+type noGeoProvider struct{}
+
+func (noGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	return map[string]GeoIP{}, nil
+}
+
+// Returns the GeoProvider named in the options' GeoIPProviders, or a
+// GeoProviderChain trying several in order.
+func newGeoProvider(options Options) (GeoProvider, error) {
+	var chain GeoProviderChain
+	for _, name := range options.GeoIPProviders {
+		var provider GeoProvider
+		var err error
+		switch name {
+		case "ip-api":
+			provider, err = newAPIGeoProvider(options)
+		case "ipinfo":
+			provider, err = newIPInfoGeoProvider(options)
+		case "ipstack":
+			provider, err = newIPStackGeoProvider(options)
+		case "mmdb":
+			if options.GeoIPDatabase == "" {
+				return nil, errors.New("the mmdb GeoIP provider requires a database file")
+			}
+			provider, err = NewMMDBGeoProvider(options.GeoIPDatabase)
+		case "static":
+			if options.GeoIPStaticFile == "" {
+				return nil, errors.New("the static GeoIP provider requires a locations file")
+			}
+			provider, err = LoadStaticGeoProvider(options.GeoIPStaticFile)
+		case "none":
+			provider = noGeoProvider{}
+		default:
+			return nil, fmt.Errorf("unknown GeoIP provider: %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, provider)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// GeoProviderChain is a GeoProvider trying several providers in order,
+// such as a local database followed by a GeoIP API. Addresses that a
+// provider fails to resolve, or that it has no data for, are looked up
+// with the next one.
+type GeoProviderChain []GeoProvider
+
+func (c GeoProviderChain) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	geos := map[string]GeoIP{}
+	remaining := addresses
+	var errs []error
+	for _, provider := range c {
+		if len(remaining) == 0 {
+			break
+		}
+		found, err := provider.Lookup(ctx, remaining)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		var unresolved []string
+		for _, address := range remaining {
+			if geo, ok := found[address]; ok {
+				geos[address] = geo
+			} else {
+				unresolved = append(unresolved, address)
+			}
+		}
+		remaining = unresolved
+	}
+	// Failures of providers that another one made up for don't matter.
+	if len(remaining) == 0 || len(errs) == 0 {
+		return geos, nil
+	}
+	if len(errs) == 1 {
+		return geos, errs[0]
+	}
+	return geos, geoProviderErrors(errs)
+}
+
+// Failures of several providers of a GeoProviderChain, matching the
+// errors of each with errors.Is, so that a rate limited provider still
+// defers the lookup.
+type geoProviderErrors []error
+
+func (errs geoProviderErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (errs geoProviderErrors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
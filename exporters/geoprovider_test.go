@@ -0,0 +1,499 @@
+package exporters
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+// Returns a provider for a GeoIP API served by the handler, counting
+// the requests it receives.
+func newTestGeoProvider(t *testing.T, handler http.HandlerFunc, requests *int) *apiGeoProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	p, err := newAPIGeoProvider(Options{
+		GeoIPURL:          server.URL + "/json/{ip}",
+		GeoIPTimeout:      time.Second,
+		GeoIPRateLimit:    -1,
+		GeoIPRetries:      2,
+		GeoIPRetryBackoff: time.Millisecond,
+		Logger:            nopLogger{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGeoProviderRetriesTransientFailures(t *testing.T) {
+	requests := 0
+	p := newTestGeoProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"query":"198.51.100.7","country":"Netherlands","regionName":"North Holland","city":"Amsterdam","lat":52.37,"lon":4.89}`))
+	}, &requests)
+
+	geos, err := p.Lookup(context.Background(), []string{"198.51.100.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo := geos["198.51.100.7"]; geo.City != "Amsterdam" {
+		t.Errorf("expected the address to be resolved, got %+v", geo)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestGeoProviderGivesUpOnPermanentFailures(t *testing.T) {
+	requests := 0
+	p := newTestGeoProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}, &requests)
+
+	if _, err := p.Lookup(context.Background(), []string{"198.51.100.7"}); err == nil {
+		t.Error("expected the lookup to fail")
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestGeoProviderStopsRetryingAfterLimit(t *testing.T) {
+	requests := 0
+	p := newTestGeoProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, &requests)
+
+	if _, err := p.Lookup(context.Background(), []string{"198.51.100.7"}); err == nil {
+		t.Error("expected the lookup to fail")
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":      0,
+		"3":     3 * time.Second,
+		"-1":    0,
+		"never": 0,
+	} {
+		if d := parseRetryAfter(value); d != expected {
+			t.Errorf("parseRetryAfter(%q) = %s, expected %s", value, d, expected)
+		}
+	}
+}
+
+func TestGeoProviderDefersRateLimitedLookups(t *testing.T) {
+	requests := 0
+	p := newTestGeoProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"query":"198.51.100.7","country":"Netherlands","lat":52.37,"lon":4.89}`))
+	}, &requests)
+	// A single lookup per minute, whose token is spent by the first one.
+	p.limiter = newGeoLimiter(1)
+	p.timeout = 50 * time.Millisecond
+
+	addresses := []string{"198.51.100.7", "198.51.100.8", "198.51.100.9"}
+	geos, err := p.Lookup(context.Background(), addresses)
+	if !errors.Is(err, errGeoRateLimited) {
+		t.Errorf("expected the rate limit to be exceeded, got %v", err)
+	}
+	if len(geos) != 1 || requests != 1 {
+		t.Errorf("expected a single lookup, got %d requests and %d results", requests, len(geos))
+	}
+
+	// The exporter counts the remaining lookups as deferred, leaving them
+	// to a later scrape.
+	e := newTestExporter(t, "server2.status", Options{})
+	e.Close()
+	e.geoProvider = GeoProviderChain{p}
+	e.lookupGeo(context.Background(), addresses[1:])
+	if deferred := testutil.ToFloat64(e.geoIPLookupsDeferred); deferred != 2 {
+		t.Errorf("expected 2 deferred lookups, got %v", deferred)
+	}
+	if failures := testutil.ToFloat64(e.geoIPLookupFailures); failures != 0 {
+		t.Errorf("expected no lookup failures, got %v", failures)
+	}
+	if _, ok := e.geoCache.get("198.51.100.8"); ok {
+		t.Error("expected deferred lookups not to be cached")
+	}
+}
+
+// GeoProvider failing every lookup.
+type failingGeoProvider struct{}
+
+func (failingGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func TestGeoProviderChainFallsBack(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{
+		GeoProvider: GeoProviderChain{failingGeoProvider{}, fakeGeoProvider{}},
+	})
+	for i := 0; i < 2; i++ {
+		compareGolden(t, e, "server2.metrics")
+	}
+	// The result of the secondary provider is cached.
+	if misses := testutil.ToFloat64(e.geoIPCacheMisses); misses != 1 {
+		t.Errorf("expected 1 cache miss, got %v", misses)
+	}
+	if failures := testutil.ToFloat64(e.geoIPLookupFailures); failures != 0 {
+		t.Errorf("expected no lookup failures, got %v", failures)
+	}
+}
+
+func TestGeoProviderChainReportsFailures(t *testing.T) {
+	chain := GeoProviderChain{failingGeoProvider{}, failingGeoProvider{}}
+	geos, err := chain.Lookup(context.Background(), []string{"198.51.100.7"})
+	if err == nil {
+		t.Error("expected an error when every provider fails")
+	}
+	if len(geos) != 0 {
+		t.Errorf("expected no results, got %v", geos)
+	}
+}
+
+// GeoProvider failing every lookup because of its rate limit.
+type rateLimitedGeoProvider struct{}
+
+func (rateLimitedGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	return nil, fmt.Errorf("%w: retry in 60s", errGeoRateLimited)
+}
+
+func TestGeoProviderChainReportsRateLimit(t *testing.T) {
+	chain := GeoProviderChain{failingGeoProvider{}, rateLimitedGeoProvider{}}
+	_, err := chain.Lookup(context.Background(), []string{"198.51.100.7"})
+	if !errors.Is(err, errGeoRateLimited) {
+		t.Errorf("expected a rate limit error, got %v", err)
+	}
+	if message := err.Error(); message != "database unavailable; GeoIP rate limit exceeded: retry in 60s" {
+		t.Errorf("unexpected error message %q", message)
+	}
+}
+
+// Returns a provider whose batch endpoint is served by a fake ip-api.com,
+// recording the addresses of every batch and failing single lookups.
+func newTestBatchGeoProvider(t *testing.T, batches *[][]string) *apiGeoProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/batch" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var addresses []string
+		if err := json.NewDecoder(r.Body).Decode(&addresses); err != nil {
+			t.Error(err)
+		}
+		*batches = append(*batches, addresses)
+		var results []map[string]interface{}
+		for _, address := range addresses {
+			results = append(results, map[string]interface{}{"status": "success", "query": address, "country": "Netherlands", "city": "Amsterdam", "lat": 52.37, "lon": 4.89})
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	t.Cleanup(server.Close)
+	p, err := newAPIGeoProvider(Options{GeoIPURL: defaultGeoIPURL, GeoIPTimeout: time.Second, GeoIPRateLimit: -1, Logger: nopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.batchURL = server.URL + "/batch"
+	return p
+}
+
+func TestGeoProviderBatchesLookups(t *testing.T) {
+	var batches [][]string
+	p := newTestBatchGeoProvider(t, &batches)
+	var addresses []string
+	for i := 0; i < 150; i++ {
+		addresses = append(addresses, fmt.Sprintf("198.51.%d.%d", 100+i/100, i%100+1))
+	}
+	geos, err := p.Lookup(context.Background(), addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(geos) != len(addresses) {
+		t.Errorf("expected %d results, got %d", len(addresses), len(geos))
+	}
+	if len(batches) != 2 || len(batches[0]) != geoIPBatchSize || len(batches[1]) != 50 {
+		t.Errorf("expected batches of 100 and 50 addresses, got %d batches", len(batches))
+	}
+}
+
+func TestResolveGeoBatchesMissingAddresses(t *testing.T) {
+	var batches [][]string
+	e := newTestExporter(t, "server2.status", Options{GeoProvider: newTestBatchGeoProvider(t, &batches), ServerAddress: "198.51.100.1"})
+	// The server's own address is resolved in the background.
+	e.Close()
+	batches = nil
+	e.geoCache.set("198.51.100.2", GeoIP{Ip: "198.51.100.2"})
+	e.resolveGeo(context.Background(), []string{"198.51.100.2", "198.51.100.3", "198.51.100.4", "198.51.100.3", "198.51.100.5"})
+	expected := [][]string{{"198.51.100.3", "198.51.100.4", "198.51.100.5"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("expected the uncached addresses to be resolved in a single batch, got %v", batches)
+	}
+}
+
+func TestIPInfoGeoProvider(t *testing.T) {
+	var paths, authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.URL.Path == "/json" {
+			w.Write([]byte(`{"ip":"203.0.113.1","city":"Frankfurt am Main","region":"Hesse","country":"DE","loc":"50.1155,8.6842"}`))
+			return
+		}
+		w.Write([]byte(`{"ip":"198.51.100.7","city":"Amsterdam","region":"North Holland","country":"NL","loc":"52.3740,4.8897"}`))
+	}))
+	defer server.Close()
+	p, err := newIPInfoGeoProvider(Options{GeoIPToken: "secret", GeoIPTimeout: time.Second, GeoIPRateLimit: -1, Logger: nopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.url = server.URL + "/{ip}/json"
+	p.selfURL = server.URL + "/json"
+
+	geos, err := p.Lookup(context.Background(), []string{"198.51.100.7", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]GeoIP{
+		"198.51.100.7": {Ip: "198.51.100.7", CountryName: "NL", RegionName: "North Holland", City: "Amsterdam", Lat: 52.374, Lon: 4.8897, Geohash: "u173zq2sdm0x"},
+		"":             {Ip: "203.0.113.1", CountryName: "DE", RegionName: "Hesse", City: "Frankfurt am Main", Lat: 50.1155, Lon: 8.6842, Geohash: "u0yjje5xuw2f"},
+	}
+	if !reflect.DeepEqual(geos, expected) {
+		t.Errorf("expected %+v, got %+v", expected, geos)
+	}
+	if !reflect.DeepEqual(paths, []string{"/198.51.100.7/json", "/json"}) {
+		t.Errorf("unexpected requests: %v", paths)
+	}
+	for _, authorization := range authorizations {
+		if authorization != "Bearer secret" {
+			t.Errorf("expected the token to be sent, got %q", authorization)
+		}
+	}
+}
+
+func TestIPStackGeoProvider(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RequestURI())
+		if r.URL.Query().Get("access_key") != "secret key" {
+			w.Write([]byte(`{"success":false,"error":{"code":101,"type":"invalid_access_key","info":"You have not supplied a valid API Access Key."}}`))
+			return
+		}
+		w.Write([]byte(`{"ip":"198.51.100.7","country_code":"NL","country_name":"Netherlands","region_name":"North Holland","city":"Amsterdam","latitude":52.374,"longitude":4.8897}`))
+	}))
+	defer server.Close()
+
+	if _, err := newIPStackGeoProvider(Options{}); err == nil {
+		t.Error("expected an error without an access key")
+	}
+	p, err := newIPStackGeoProvider(Options{GeoIPToken: "secret key", GeoIPTimeout: time.Second, GeoIPRateLimit: -1, Logger: nopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.url = strings.Replace(p.url, "http://api.ipstack.com", server.URL, 1)
+	p.selfURL = strings.Replace(p.selfURL, "http://api.ipstack.com", server.URL, 1)
+
+	geos, err := p.Lookup(context.Background(), []string{"198.51.100.7", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amsterdam := GeoIP{Ip: "198.51.100.7", CountryName: "Netherlands", RegionName: "North Holland", City: "Amsterdam", Lat: 52.374, Lon: 4.8897, Geohash: "u173zq2sdm0x"}
+	if geos["198.51.100.7"] != amsterdam {
+		t.Errorf("expected %+v, got %+v", amsterdam, geos["198.51.100.7"])
+	}
+	expected := []string{"/198.51.100.7?access_key=secret+key", "/check?access_key=secret+key"}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("expected requests %v, got %v", expected, queries)
+	}
+
+	p.url = strings.Replace(p.url, "secret+key", "wrong", 1)
+	if _, err := p.Lookup(context.Background(), []string{"198.51.100.7"}); err == nil || !strings.Contains(err.Error(), "valid API Access Key") {
+		t.Errorf("expected the API's error, got %v", err)
+	}
+}
+
+func TestStaticGeoProvider(t *testing.T) {
+	p, err := parseStaticGeoProvider([]byte(`[
+		{"cidr": "198.51.100.0/24", "country": "Netherlands", "city": "Amsterdam", "lat": 52.37, "lon": 4.89},
+		{"cidr": "198.51.100.7/32", "country": "Germany", "city": "Frankfurt"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geos, err := p.Lookup(context.Background(), []string{"198.51.100.1", "198.51.100.7", "203.0.113.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]GeoIP{
+		"198.51.100.1": {Ip: "198.51.100.1", CountryName: "Netherlands", City: "Amsterdam", Lat: 52.37, Lon: 4.89, Geohash: "u173zm8v3786"},
+		"198.51.100.7": {Ip: "198.51.100.7", CountryName: "Germany", City: "Frankfurt"},
+	}
+	if !reflect.DeepEqual(geos, expected) {
+		t.Errorf("expected %+v, got %+v", expected, geos)
+	}
+
+	for _, contents := range []string{
+		`{}`,
+		`[{"cidr": "198.51.100.0"}]`,
+		`[{"cidr": "198.51.100.0/24", "lat": 52.37}]`,
+		`[{"cidr": "198.51.100.0/24", "lat": 95, "lon": 4.89}]`,
+	} {
+		if _, err := parseStaticGeoProvider([]byte(contents)); err == nil {
+			t.Errorf("expected an error parsing %s", contents)
+		}
+	}
+}
+
+func TestGeoIPProviders(t *testing.T) {
+	static := filepath.Join(t.TempDir(), "locations.json")
+	if err := os.WriteFile(static, []byte(`[{"cidr": "0.0.0.0/0", "country": "Netherlands"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newGeoProvider(Options{
+		GeoIPProviders:  []string{"mmdb", "static"},
+		GeoIPDatabase:   writeTestMMDB(t),
+		GeoIPStaticFile: static,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geos, err := p.Lookup(context.Background(), []string{"203.0.113.7", "198.51.100.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if city := geos["203.0.113.7"].City; city != "Amsterdam" {
+		t.Errorf("expected the database to resolve 203.0.113.7, got %q", city)
+	}
+	if country := geos["198.51.100.1"].CountryName; country != "Netherlands" {
+		t.Errorf("expected the static locations to resolve 198.51.100.1, got %q", country)
+	}
+
+	// Selecting no provider leaves the geo labels empty without lookups.
+	e, err := NewOpenVPNExporter(filepath.Join("testdata", "server2.status"), Options{GeoIPProviders: []string{"none"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := gatherLabel(t, e, "openvpn_server_connected_clients", "server_country"); value != "" {
+		t.Errorf("expected an empty server country, got %q", value)
+	}
+
+	for _, options := range []Options{
+		{GeoIPProviders: []string{"maxmind"}},
+		{GeoIPProviders: []string{"mmdb"}},
+		{GeoIPProviders: []string{"static"}, GeoIPStaticFile: filepath.Join(t.TempDir(), "missing.json")},
+	} {
+		if _, err := newGeoProvider(options); err == nil {
+			t.Errorf("expected an error for %v", options.GeoIPProviders)
+		}
+	}
+}
+
+func TestIPAPIProEndpoint(t *testing.T) {
+	p, err := newAPIGeoProvider(Options{GeoIPURL: "https://pro.ip-api.com/json/{ip}?key={key}", GeoIPToken: "a&b", GeoIPRateLimit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://pro.ip-api.com/json/{ip}?key=a%26b"; p.url != expected {
+		t.Errorf("expected URL %s, got %s", expected, p.url)
+	}
+	if expected := "https://pro.ip-api.com/batch?key=a%26b"; p.batchURL != expected {
+		t.Errorf("expected batch URL %s, got %s", expected, p.batchURL)
+	}
+	if p.batchLimiter.Limit() != rate.Inf {
+		t.Errorf("expected batch lookups not to be rate limited, got %v", p.batchLimiter.Limit())
+	}
+
+	// The pro endpoint isn't rate limited by default.
+	e := newTestExporter(t, "server2.status", Options{GeoIPURL: "https://pro.ip-api.com/json/{ip}?key=secret"})
+	if e.options.GeoIPRateLimit >= 0 {
+		t.Errorf("expected no rate limit, got %v", e.options.GeoIPRateLimit)
+	}
+	e = newTestExporter(t, "server2.status", Options{})
+	if e.options.GeoIPRateLimit != defaultGeoIPRateLimit {
+		t.Errorf("expected the default rate limit, got %v", e.options.GeoIPRateLimit)
+	}
+}
+
+func TestGeoIPExcludedPrefixes(t *testing.T) {
+	requests := 0
+	var paths []string
+	p := newTestGeoProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"query":"192.0.2.1","country":"Netherlands","regionName":"Utrecht","city":"Utrecht","lat":52.09,"lon":5.12}`))
+	}, &requests)
+	e := newTestExporter(t, "server2_private.status", Options{GeoProvider: p})
+	if country := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "country"); country != "" {
+		t.Errorf("expected no country for a private address, got %q", country)
+	}
+	// Only the server's own address is looked up.
+	for _, path := range paths {
+		if path != "/json/" {
+			t.Errorf("expected no lookup of client addresses, got a request for %s", path)
+		}
+	}
+}
+
+// GeoProvider placing every client at the given coordinates.
+type coordinatesGeoProvider struct {
+	lat, lon float64
+}
+
+func (p coordinatesGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	geos, err := fakeGeoProvider{}.Lookup(ctx, addresses)
+	for address, geo := range geos {
+		if address != "" {
+			geo.Lat, geo.Lon = p.lat, p.lon
+			geos[address] = geo
+		}
+	}
+	return geos, err
+}
+
+func TestInvalidCoordinates(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		lat, lon float64
+	}{
+		{"zero", 0, 0},
+		{"latitude out of range", 91, 4.89},
+		{"longitude out of range", 52.37, -181},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestExporter(t, "server2.status", Options{
+				GeoProvider:       coordinatesGeoProvider{test.lat, test.lon},
+				ClientCoordinates: true,
+			})
+			if hash := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "geohash"); hash != "" {
+				t.Errorf("expected no geohash, got %q", hash)
+			}
+			for _, name := range []string{"openvpn_server_client_distance", "openvpn_server_client_latitude", "openvpn_server_client_longitude"} {
+				if count := gatherCount(t, e, name); count != 0 {
+					t.Errorf("expected no %s metrics, got %d", name, count)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package exporters
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"sort"
+
+	"github.com/mmcloughlin/geohash"
+)
+
+// StaticGeoLocation is the location of the addresses in a range.
+type StaticGeoLocation struct {
+	Prefix netip.Prefix
+	GeoIP
+}
+
+// StaticGeoProvider is a GeoProvider placing addresses at fixed
+// locations, such as the offices that clients connect from. The most
+// specific range holding an address wins, and addresses outside of all
+// ranges remain unresolved.
+type StaticGeoProvider []StaticGeoLocation
+
+// LoadStaticGeoProvider reads a JSON file listing the locations of
+// address ranges, such as:
+//
+//	[
+//	  {"cidr": "203.0.113.0/24", "country": "Netherlands", "city": "Amsterdam", "lat": 52.37, "lon": 4.89},
+//	  {"cidr": "198.51.100.7/32", "country": "Germany", "region": "Hesse", "city": "Frankfurt"}
+//	]
+func LoadStaticGeoProvider(path string) (StaticGeoProvider, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := parseStaticGeoProvider(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return provider, nil
+}
+
+func parseStaticGeoProvider(contents []byte) (StaticGeoProvider, error) {
+	var entries []struct {
+		CIDR    string   `json:"cidr"`
+		Country string   `json:"country"`
+		Region  string   `json:"region"`
+		City    string   `json:"city"`
+		Lat     *float64 `json:"lat"`
+		Lon     *float64 `json:"lon"`
+	}
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return nil, err
+	}
+	var provider StaticGeoProvider
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		location := StaticGeoLocation{
+			Prefix: prefix.Masked(),
+			GeoIP:  GeoIP{CountryName: entry.Country, RegionName: entry.Region, City: entry.City},
+		}
+		if (entry.Lat == nil) != (entry.Lon == nil) {
+			return nil, fmt.Errorf("%s: lat and lon must be given together", entry.CIDR)
+		}
+		if entry.Lat != nil {
+			location.Lat, location.Lon = *entry.Lat, *entry.Lon
+			if !validCoordinates(location.Lat, location.Lon) {
+				return nil, fmt.Errorf("%s: coordinates out of range: %v, %v", entry.CIDR, location.Lat, location.Lon)
+			}
+			location.Geohash = geohash.Encode(location.Lat, location.Lon)
+		}
+		provider = append(provider, location)
+	}
+	// Looking the ranges up from the most specific one on makes it win.
+	sort.SliceStable(provider, func(i, j int) bool {
+		return provider[i].Prefix.Bits() > provider[j].Prefix.Bits()
+	})
+	return provider, nil
+}
+
+// Lookup resolves the addresses within the provider's ranges. The
+// provider's own address can't be resolved.
+func (p StaticGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	geos := map[string]GeoIP{}
+	var lastErr error
+	for _, address := range addresses {
+		if address == "" {
+			lastErr = errors.New("static locations can't resolve the exporter's own address")
+			continue
+		}
+		ip, err := netip.ParseAddr(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ip = ip.Unmap()
+		for _, location := range p {
+			if location.Prefix.Contains(ip) {
+				geo := location.GeoIP
+				geo.Ip = address
+				geos[address] = geo
+				break
+			}
+		}
+	}
+	return geos, lastErr
+}
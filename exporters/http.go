@@ -0,0 +1,259 @@
+package exporters
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Collector of the exporter's metrics that gives up collecting once the
+// context of the scrape request is done.
+type contextCollector struct {
+	ctx      context.Context
+	exporter *OpenVPNExporter
+}
+
+func (c contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collect(c.ctx, ch)
+}
+
+// WebOptions holds the optional security settings of the HTTP server.
+// The zero value serves plain HTTP without authentication.
+type WebOptions struct {
+	// Serve HTTPS using this certificate and key, given as paths to
+	// PEM encoded files.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Require requests for metrics to carry this token in a bearer
+	// Authorization header.
+	BearerToken string
+	// Time given to scrapes in progress to finish when shutting down.
+	// Defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+	// Reloads the configuration, as by calling SetStatusSources, when
+	// /-/reload is posted to, which requires the bearer token if one is
+	// configured. Nil disables the endpoint.
+	Reload func() error
+}
+
+// Default time given to scrapes in progress when shutting down, which
+// matches the default grace period of Kubernetes pods.
+const defaultShutdownTimeout = 30 * time.Second
+
+// Handler returns an HTTP handler serving the exporter's metrics at the
+// given path, along with the Go runtime, process and build metrics, and a
+// landing page linking to them at the root. A readiness check is served
+// at /healthz. Collection is cancelled when the scrape request is, or
+// when the scrape timeout announced by Prometheus passes.
+func (e *OpenVPNExporter) Handler(metricsPath string, web WebOptions) (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(prometheus.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if err := registry.Register(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+	// Version information set at build time using -ldflags.
+	if err := registry.Register(version.NewCollector("openvpn_exporter")); err != nil {
+		return nil, err
+	}
+	// Registering the exporter once validates its descriptors up front,
+	// as it is only registered with a registry per request below.
+	if err := prometheus.NewRegistry().Register(e); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, web.BearerToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := r.Context()
+		if timeout, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout*float64(time.Second)))
+			defer cancel()
+		}
+
+		// The exporter is registered for every request, so that it
+		// collects with the request's context.
+		exporterRegistry := prometheus.NewRegistry()
+		exporterRegistry.MustRegister(contextCollector{ctx: ctx, exporter: e})
+		gatherers := prometheus.Gatherers{registry, exporterRegistry}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/healthz", e.serveHealth)
+	if web.Reload != nil {
+		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				w.Header().Set("Allow", "POST, PUT")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !authorized(r, web.BearerToken) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err := web.Reload(); err != nil {
+				http.Error(w, fmt.Sprintf("failed to reload: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("ok\n"))
+		})
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`
+			<html>
+			<head><title>OpenVPN Exporter</title></head>
+			<body>
+			<h1>OpenVPN Exporter</h1>
+			<p><a href='` + metricsPath + `'>Metrics</a></p>
+			</body>
+			</html>`))
+	})
+	return mux, nil
+}
+
+// Responds whether the status sources are available, without collecting
+// them, so that the check is cheap enough for frequent probes.
+func (e *OpenVPNExporter) serveHealth(w http.ResponseWriter, r *http.Request) {
+	for _, source := range e.expandSources() {
+		if err := checkStatusSource(source.Path); err != nil {
+			http.Error(w, fmt.Sprintf("status source %s unavailable: %v", source.Name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Checks whether a status source can be opened: that the status file,
+// management socket or sacli command exists, or that the management
+// interface, SSH server, HTTP server or firewall API accepts
+// connections.
+func checkStatusSource(path string) error {
+	u, err := url.Parse(path)
+	if _, api, ok := firewallURL(u); err == nil && ok {
+		u = api
+	}
+	if err == nil && (u.Scheme == "tcp" || u.Scheme == "ssh" || u.Scheme == "http" || u.Scheme == "https") {
+		address := u.Host
+		if u.Port() == "" && u.Scheme != "tcp" {
+			address = net.JoinHostPort(u.Hostname(), u.Scheme)
+		}
+		conn, err := net.DialTimeout("tcp", address, managementTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	} else if err == nil && u.Scheme == "unix" {
+		_, err := os.Stat(u.Path)
+		return err
+	} else if err == nil && u.Scheme == "sacli" {
+		_, err := exec.LookPath(sacliCommand(u))
+		return err
+	}
+	_, err = os.Stat(path)
+	return err
+}
+
+// Returns whether a request carries the bearer token, if one is
+// required.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	expected := []byte("Bearer " + token)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// Returns an HTTP server for the exporter's handler, configured for TLS
+// if a certificate is given.
+func (e *OpenVPNExporter) newServer(addr string, metricsPath string, web WebOptions) (*http.Server, error) {
+	handler, err := e.Handler(metricsPath, web)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Addr: addr, Handler: handler}
+	if web.TLSCertFile != "" || web.TLSKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(web.TLSCertFile, web.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	return server, nil
+}
+
+// Serve exposes the exporter's metrics over HTTP, or HTTPS if a
+// certificate is given, on the given address, blocking until the server
+// fails.
+func (e *OpenVPNExporter) Serve(addr string, metricsPath string, web WebOptions) error {
+	return e.ServeContext(context.Background(), addr, metricsPath, web)
+}
+
+// ServeContext is like Serve, but shuts the server down gracefully once
+// the context is done: it stops accepting connections, waits for the
+// scrapes in progress to finish within the shutdown timeout, and closes
+// the exporter. Returns nil after a graceful shutdown.
+func (e *OpenVPNExporter) ServeContext(ctx context.Context, addr string, metricsPath string, web WebOptions) error {
+	server, err := e.newServer(addr, metricsPath, web)
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return e.serveUntilDone(ctx, server, listener, web.ShutdownTimeout)
+}
+
+// Serves on the listener until the context is done, then shuts the
+// server down and closes the exporter.
+func (e *OpenVPNExporter) serveUntilDone(ctx context.Context, server *http.Server, listener net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ServeTLS(listener, "", "")
+		} else {
+			errs <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	e.Close()
+	return err
+}
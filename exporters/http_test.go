@@ -0,0 +1,267 @@
+package exporters
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthz(t *testing.T) {
+	for _, test := range []struct {
+		status string
+		code   int
+	}{
+		{"server2.status", http.StatusOK},
+		{"missing.status", http.StatusServiceUnavailable},
+	} {
+		t.Run(test.status, func(t *testing.T) {
+			e := newTestExporter(t, test.status, Options{})
+			handler, err := e.Handler("/metrics", WebOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if recorder.Code != test.code {
+				t.Errorf("expected status %d, got %d: %s", test.code, recorder.Code, recorder.Body)
+			}
+			// The check shouldn't collect the status.
+			if misses := testutil.ToFloat64(e.geoIPCacheMisses); misses != 0 {
+				t.Errorf("expected no GeoIP lookups, got %v", misses)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+	handler, err := e.Handler("/metrics", WebOptions{BearerToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path          string
+		authorization string
+		code          int
+	}{
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer wrong", http.StatusUnauthorized},
+		{"/metrics", "Basic secret", http.StatusUnauthorized},
+		{"/metrics", "Bearer secret", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s with %q: expected status %d, got %d", test.path, test.authorization, test.code, recorder.Code)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+	reloads := 0
+	handler, err := e.Handler("/metrics", WebOptions{
+		BearerToken: "secret",
+		Reload: func() error {
+			reloads++
+			return e.SetStatusSources([]StatusSource{{Name: "tcp", Path: filepath.Join("testdata", "server3.status")}})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method        string
+		authorization string
+		code          int
+	}{
+		{http.MethodGet, "Bearer secret", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", http.StatusUnauthorized},
+		{http.MethodPost, "Bearer secret", http.StatusOK},
+	} {
+		request := httptest.NewRequest(test.method, "/-/reload", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s with %q: expected status %d, got %d", test.method, test.authorization, test.code, recorder.Code)
+		}
+	}
+	if reloads != 1 {
+		t.Errorf("expected a single reload, got %d", reloads)
+	}
+	if name := gatherLabel(t, e, "openvpn_up", "server_name"); name != "tcp" {
+		t.Errorf("expected the reloaded source to be collected, got %q", name)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t)
+	e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+	server, err := e.newServer("", "/metrics", WebOptions{TLSCertFile: certFile, TLSKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	response, err := client.Get("https://" + listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, response.StatusCode)
+	}
+}
+
+func TestTLSMissingKey(t *testing.T) {
+	certFile, _, _ := writeSelfSignedCert(t)
+	e := newTestExporter(t, "server2.status", Options{})
+	if _, err := e.newServer("", "/metrics", WebOptions{TLSCertFile: certFile}); err == nil {
+		t.Error("expected an error for a certificate without a key")
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to
+// a temporary directory, returning their paths and a pool trusting it.
+func writeSelfSignedCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "openvpn_exporter test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestBuildInfo(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+	handler, err := e.Handler("/metrics", WebOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "openvpn_exporter_build_info{") {
+		t.Errorf("expected a build info metric, got:\n%s", recorder.Body)
+	}
+}
+
+// GeoProvider that announces client lookups and holds them back until
+// released.
+type blockingGeoProvider struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p blockingGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	if len(addresses) != 1 || addresses[0] != "" {
+		p.started <- struct{}{}
+		<-p.release
+	}
+	return fakeGeoProvider{}.Lookup(ctx, addresses)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	provider := blockingGeoProvider{started: make(chan struct{}), release: make(chan struct{})}
+	e := newTestExporter(t, "server2.status", Options{GeoProvider: provider})
+	server, err := e.newServer("", "/metrics", WebOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- e.serveUntilDone(ctx, server, listener, 5*time.Second)
+	}()
+
+	responses := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+		if err != nil {
+			responses <- 0
+			return
+		}
+		response.Body.Close()
+		responses <- response.StatusCode
+	}()
+
+	// Shutting down waits for the scrape in progress.
+	<-provider.started
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("server shut down during a scrape: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(provider.release)
+	if code := <-responses; code != http.StatusOK {
+		t.Errorf("expected status %d for the scrape in progress, got %d", http.StatusOK, code)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected a graceful shutdown, got %v", err)
+	}
+}
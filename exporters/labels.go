@@ -0,0 +1,159 @@
+package exporters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// LabelMode controls how an identifying client label is exported.
+type LabelMode int
+
+const (
+	// Export the raw value.
+	LabelKeep LabelMode = iota
+	// Omit the label entirely.
+	LabelDrop
+	// Replace the value by a stable salted hash.
+	LabelHash
+)
+
+// Client labels that identify a person, whose mode can be configured.
+var identifyingLabels = map[string]bool{
+	"common_name":  true,
+	"username":     true,
+	"real_address": true,
+}
+
+// Checks that label modes are only configured for identifying labels.
+func validateLabelModes(modes map[string]LabelMode) error {
+	for name := range modes {
+		if !identifyingLabels[name] {
+			return fmt.Errorf("label mode configured for non-identifying label %q", name)
+		}
+	}
+	return nil
+}
+
+// Client labels that can be selected with the ClientLabels option. The
+// server labels are always exported.
+var optionalClientLabels = []string{"common_name", "connection_time", "real_address", "virtual_address", "virtual_ipv6_address", "username", "client_id", "peer_id", "data_channel_cipher", "geohash", "city", "country", "region"}
+
+// Optional client labels only exported when selected, as they duplicate
+// an info metric.
+var unselectedClientLabels = map[string]bool{
+	"data_channel_cipher": true,
+}
+
+// Returns the label modes with every optional client label that isn't
+// selected dropped. A nil selection keeps all labels but those only
+// exported when selected.
+func selectClientLabels(modes map[string]LabelMode, selected []string) (map[string]LabelMode, error) {
+	if selected == nil {
+		selectedModes := map[string]LabelMode{}
+		for name, mode := range modes {
+			selectedModes[name] = mode
+		}
+		for name := range unselectedClientLabels {
+			selectedModes[name] = LabelDrop
+		}
+		return selectedModes, nil
+	}
+	known := map[string]bool{}
+	for _, name := range optionalClientLabels {
+		known[name] = true
+	}
+	kept := map[string]bool{}
+	for _, name := range selected {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown client label %q, expected one of %s", name, strings.Join(optionalClientLabels, ", "))
+		}
+		kept[name] = true
+	}
+	selectedModes := map[string]LabelMode{}
+	for name, mode := range modes {
+		selectedModes[name] = mode
+	}
+	for _, name := range optionalClientLabels {
+		if !kept[name] {
+			selectedModes[name] = LabelDrop
+		}
+	}
+	return selectedModes, nil
+}
+
+// Labels of metrics carrying the server labels, which extra server
+// labels can't be named after.
+var reservedServerLabels = append(append([]string{}, optionalClientLabels...),
+	"version", "cipher", "tls_version", "direction", "reason")
+
+// Checks that extra server labels are valid label names, distinct from
+// each other and from the labels of the exporter's metrics.
+func validateServerLabels(names []string) error {
+	reserved := map[string]bool{}
+	for _, name := range append(append([]string{}, serverLabels...), reservedServerLabels...) {
+		reserved[name] = true
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		switch {
+		case !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix):
+			return fmt.Errorf("invalid server label name %q", name)
+		case reserved[name]:
+			return fmt.Errorf("server label %q clashes with a label of the exporter's metrics", name)
+		case seen[name]:
+			return fmt.Errorf("duplicate server label %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Returns the names of the labels of status sources, sorted.
+func sourceLabelNames(sources []StatusSource) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, source := range sources {
+		for name := range source.Labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Applies label modes to parallel lists of label names and the columns
+// they are taken from. Returns the lists without the dropped labels,
+// and the columns whose values are to be hashed.
+func applyLabelModes(modes map[string]LabelMode, names []string, columns []string) ([]string, []string, map[string]bool) {
+	var keptNames, keptColumns []string
+	hashedColumns := map[string]bool{}
+	for i, name := range names {
+		switch modes[name] {
+		case LabelDrop:
+			continue
+		case LabelHash:
+			hashedColumns[columns[i]] = true
+		}
+		keptNames = append(keptNames, name)
+		keptColumns = append(keptColumns, columns[i])
+	}
+	return keptNames, keptColumns, hashedColumns
+}
+
+// Replaces a label value by the truncated SHA-256 hash of the salt and
+// the value. Empty values are kept empty.
+func hashLabelValue(salt string, value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(salt + value))
+	return hex.EncodeToString(sum[:8])
+}
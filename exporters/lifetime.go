@@ -0,0 +1,82 @@
+package exporters
+
+import "sync"
+
+// Byte counts of a session as seen during the previous scrape.
+type sessionCounts struct {
+	received   float64
+	sent       float64
+	generation uint64
+}
+
+// Cumulative byte counts of a common name over all of its sessions.
+type lifetimeCounts struct {
+	received float64
+	sent     float64
+}
+
+// Sums the byte counts of the sessions of every common name, so that
+// its totals keep growing across reconnects and server restarts, which
+// reset the per-session counters. Sessions are keyed on common name,
+// real address and connection time, so that a client reconnecting from
+// the same address starts a new session.
+//
+// The totals of a common name are retained for the lifetime of the
+// exporter, even once it disconnects, so their number only grows with
+// every distinct common name ever seen.
+type clientLifetimes struct {
+	mutex      sync.Mutex
+	sessions   map[string]sessionCounts
+	totals     map[string]*lifetimeCounts
+	generation uint64
+}
+
+func newClientLifetimes() *clientLifetimes {
+	return &clientLifetimes{
+		sessions: map[string]sessionCounts{},
+		totals:   map[string]*lifetimeCounts{},
+	}
+}
+
+// Adds the traffic of a session since the previous scrape to the totals
+// of its common name. New sessions count from zero, as do sessions whose
+// counters went down, since the server must have restarted them.
+func (l *clientLifetimes) update(commonName string, session string, received float64, sent float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := commonName + "\x00" + session
+	previous, ok := l.sessions[key]
+	l.sessions[key] = sessionCounts{received: received, sent: sent, generation: l.generation}
+	total, found := l.totals[commonName]
+	if !found {
+		total = &lifetimeCounts{}
+		l.totals[commonName] = total
+	}
+	if !ok || received < previous.received || sent < previous.sent {
+		previous = sessionCounts{}
+	}
+	total.received += received - previous.received
+	total.sent += sent - previous.sent
+}
+
+// Calls f with the totals of every common name ever seen.
+func (l *clientLifetimes) each(f func(commonName string, received float64, sent float64)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for commonName, total := range l.totals {
+		f(commonName, total.received, total.sent)
+	}
+}
+
+// Forgets the sessions that were not seen since the previous call. The
+// totals of their common names are kept.
+func (l *clientLifetimes) prune() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, session := range l.sessions {
+		if session.generation != l.generation {
+			delete(l.sessions, key)
+		}
+	}
+	l.generation++
+}
@@ -0,0 +1,76 @@
+package exporters
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the exporter's log messages, by level.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Logger discarding all messages, used when none is configured.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// Log levels, in increasing order of severity.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// ParseLevel returns the log level with the given name, being one of
+// debug, info, warn or error.
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %q", name)
+}
+
+// StdLogger is a Logger writing messages of at least the given level to
+// a standard library logger, in logfmt style.
+type StdLogger struct {
+	Logger *log.Logger
+	Level  int
+}
+
+func (l StdLogger) logf(level int, name string, format string, args []interface{}) {
+	if level >= l.Level {
+		l.Logger.Printf("level=%s msg=%q", name, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l StdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, "debug", format, args)
+}
+
+func (l StdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, "info", format, args)
+}
+
+func (l StdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, "warn", format, args)
+}
+
+func (l StdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, "error", format, args)
+}
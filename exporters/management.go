@@ -0,0 +1,178 @@
+package exporters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Timeout of a complete exchange with the management interface.
+const managementTimeout = 10 * time.Second
+
+// Returned when the management interface rejects the password, or asks
+// for one when none is configured.
+var errManagementAuth = errors.New("management interface rejected the password")
+
+// Collects the status of an OpenVPN instance through its management
+// interface, given as a tcp://[:password@]host:port URL or, for
+// interfaces bound to a unix domain socket, a unix:///path URL.
+// Interfaces without a password in their URL authenticate with the
+// configured management password, if any. The status 3 command returns the same data as a version 3 status file,
+// whose tab separated fields allow commas in common names.
+func (e *OpenVPNExporter) collectStatusFromManagement(ctx context.Context, source *statusSource, u *url.URL, ch chan<- prometheus.Metric) error {
+	address := managementAddress(u)
+	if u.Scheme == "unix" && e.options.ManagementSocketMode != 0 {
+		if err := checkSocketMode(address, e.options.ManagementSocketMode); err != nil {
+			return &collectError{reason: "permissions", err: err}
+		}
+	}
+	status, err := readManagementStatus(ctx, u.Scheme, address, e.managementPassword(u))
+	authFailed := 0.0
+	if errors.Is(err, errManagementAuth) {
+		authFailed = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.openvpnManagementAuthFailedDesc,
+		prometheus.GaugeValue,
+		authFailed,
+		source.Name)
+	if authFailed == 1.0 {
+		return &collectError{reason: "auth", err: err}
+	} else if err != nil {
+		return &collectError{reason: "open", err: err}
+	}
+	return e.collectStatusFromReader(ctx, source, bytes.NewReader(status), ch)
+}
+
+// Returns the address to dial a management interface URL at.
+func managementAddress(u *url.URL) string {
+	if u.Scheme == "unix" {
+		return u.Path
+	}
+	return u.Host
+}
+
+// Returns the password of a management interface URL, defaulting to the
+// configured management password.
+func (e *OpenVPNExporter) managementPassword(u *url.URL) string {
+	if password, ok := u.User.Password(); ok {
+		return password
+	}
+	return e.options.ManagementPassword
+}
+
+// Checks that a path is a unix domain socket whose permission bits are
+// within the given mode.
+func checkSocketMode(path string, mode os.FileMode) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+	if excess := info.Mode().Perm() &^ mode.Perm(); excess != 0 {
+		return fmt.Errorf("%s has permissions %v, exceeding %v", path, info.Mode().Perm(), mode.Perm())
+	}
+	return nil
+}
+
+// Connects to a management interface, authenticating with the password
+// if one is given. The connection has a deadline of the management
+// timeout, or of the context if that is earlier.
+func openManagement(ctx context.Context, network string, address string, password string) (net.Conn, *bufio.Reader, error) {
+	dialer := net.Dialer{Timeout: managementTimeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	deadline := time.Now().Add(managementTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if password != "" {
+		if err := authenticateManagement(conn, reader, password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+// Answers the password prompt of a management interface.
+func authenticateManagement(conn net.Conn, reader *bufio.Reader, password string) error {
+	// The password prompt isn't terminated by a newline.
+	prompt, err := reader.ReadString(':')
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(prompt, "ENTER PASSWORD:") {
+		return fmt.Errorf("unexpected management interface prompt: %q", prompt)
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", password); err != nil {
+		return err
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(response, "ERROR:") {
+		return fmt.Errorf("%w: %s", errManagementAuth, strings.TrimSpace(response))
+	} else if !strings.HasPrefix(response, "SUCCESS:") {
+		return fmt.Errorf("unexpected management interface response: %q", response)
+	}
+	return nil
+}
+
+// Connects to a management interface, authenticating with the password
+// if one is given, and returns the output of the status 3 command. The
+// exchange ends no later than the deadline of the context.
+func readManagementStatus(ctx context.Context, network string, address string, password string) ([]byte, error) {
+	conn, reader, err := openManagement(ctx, network, address, password)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "status 3\n"); err != nil {
+		return nil, err
+	}
+
+	var status bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "ENTER PASSWORD:") {
+			// The status command was taken as a wrong password.
+			return nil, fmt.Errorf("%w: no password configured", errManagementAuth)
+		} else if strings.HasPrefix(line, ">") || strings.HasPrefix(line, "SUCCESS:") {
+			// Real-time notifications, such as the >INFO banner,
+			// and the response to a correct password.
+			continue
+		} else if strings.HasPrefix(line, "ERROR:") {
+			return nil, fmt.Errorf("management interface: %s", line)
+		}
+		status.WriteString(line)
+		status.WriteByte('\n')
+		if line == "END" {
+			break
+		}
+	}
+	fmt.Fprintf(conn, "quit\n")
+	return status.Bytes(), nil
+}
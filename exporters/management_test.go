@@ -0,0 +1,208 @@
+package exporters
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Serves a status file on a fake management interface listening on a
+// TCP or unix address, which prompts for the password if one is given,
+// answers the status 3 command, and notifies the byte counts of client
+// 0 twice after the bytecount command.
+func serveManagement(t *testing.T, network string, address string, statusFile string, password string) string {
+	t.Helper()
+	status, err := ioutil.ReadFile(filepath.Join("testdata", statusFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if password != "" {
+					conn.Write([]byte("ENTER PASSWORD:"))
+					if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != password {
+						conn.Write([]byte("ERROR: bad password\r\n"))
+						return
+					}
+					conn.Write([]byte("SUCCESS: password is correct\r\n"))
+				}
+				conn.Write([]byte(">INFO:OpenVPN Management Interface Version 3 -- type 'help' for more info\r\n"))
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.TrimSpace(line); {
+					case command == "status 3":
+						conn.Write(status)
+					case strings.HasPrefix(command, "bytecount "):
+						conn.Write([]byte("SUCCESS: bytecount interval changed\r\n"))
+						conn.Write([]byte(">BYTECOUNT_CLI:0,1000,2000\r\n"))
+						time.Sleep(100 * time.Millisecond)
+						conn.Write([]byte(">BYTECOUNT_CLI:0,3000,6000\r\n"))
+					case command == "quit":
+						return
+					default:
+						conn.Write([]byte("ERROR: unexpected command\r\n"))
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestCollectManagementInterface(t *testing.T) {
+	for _, password := range []string{"", "secret"} {
+		address := serveManagement(t, "tcp", "127.0.0.1:0", "server3.status", password)
+		path := "tcp://" + address
+		if password != "" {
+			path = "tcp://:" + password + "@" + address
+		}
+		e, err := NewOpenVPNExporter(path, Options{
+			GeoProvider: fakeGeoProvider{},
+			ServerName:  "testdata/server3.status",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareGolden(t, e, "server3.metrics")
+	}
+}
+
+func TestCollectManagementInterfaceWrongPassword(t *testing.T) {
+	address := serveManagement(t, "tcp", "127.0.0.1:0", "server3.status", "secret")
+	for _, test := range []struct {
+		path     string
+		password string
+	}{
+		{path: "tcp://:wrong@" + address},
+		// The password in the URL takes precedence.
+		{path: "tcp://:wrong@" + address, password: "secret"},
+		{path: "tcp://" + address, password: "wrong"},
+		{path: "tcp://" + address},
+	} {
+		e, err := NewOpenVPNExporter(test.path, Options{DisableGeoIP: true, ManagementPassword: test.password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := gatherLabel(t, e, "openvpn_collect_error", "reason"); reason != "auth" {
+			t.Errorf("%s with password %q: expected the scrape to fail authenticating, got reason %q", test.path, test.password, reason)
+		}
+		expected := `# HELP openvpn_management_auth_failed Whether the management interface rejected the password, or asked for one when none is configured.
+# TYPE openvpn_management_auth_failed gauge
+openvpn_management_auth_failed{server_name="` + redactStatusPath(test.path) + `"} 1
+`
+		if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_management_auth_failed"); err != nil {
+			t.Errorf("%s with password %q: %v", test.path, test.password, err)
+		}
+	}
+}
+
+func TestCollectManagementInterfacePassword(t *testing.T) {
+	address := serveManagement(t, "tcp", "127.0.0.1:0", "server3.status", "secret")
+	e, err := NewOpenVPNExporter("tcp://"+address, Options{DisableGeoIP: true, ManagementPassword: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP openvpn_management_auth_failed Whether the management interface rejected the password, or asked for one when none is configured.
+# TYPE openvpn_management_auth_failed gauge
+openvpn_management_auth_failed{server_name="tcp://` + address + `"} 0
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_management_auth_failed"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectManagementSocket(t *testing.T) {
+	path := serveManagement(t, "unix", filepath.Join(t.TempDir(), "management.sock"), "server3.status", "")
+	for _, test := range []struct {
+		perm   os.FileMode
+		mode   os.FileMode
+		reason string
+	}{
+		{0666, 0, ""},
+		{0660, 0660, ""},
+		{0600, 0660, ""},
+		{0666, 0660, "permissions"},
+	} {
+		if err := os.Chmod(path, test.perm); err != nil {
+			t.Fatal(err)
+		}
+		e, err := NewOpenVPNExporter("unix://"+path, Options{DisableGeoIP: true, ManagementSocketMode: test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.reason == "" {
+			if errors := gatherCount(t, e, "openvpn_collect_error"); errors != 0 {
+				t.Errorf("expected the scrape to succeed with permissions %v and mode %v", test.perm, test.mode)
+			}
+		} else if reason := gatherLabel(t, e, "openvpn_collect_error", "reason"); reason != test.reason {
+			t.Errorf("expected the scrape to fail with reason %q with permissions %v and mode %v, got %q", test.reason, test.perm, test.mode, reason)
+		}
+	}
+}
+
+func TestManagementBytecount(t *testing.T) {
+	address := serveManagement(t, "tcp", "127.0.0.1:0", "server2_openvpn26.status", "secret")
+	e, err := NewOpenVPNExporter("tcp://"+address, Options{
+		DisableGeoIP:                true,
+		ManagementPassword:          "secret",
+		ManagementBytecountInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for gatherCount(t, e, "openvpn_server_client_bandwidth_bytes_per_second") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the bandwidth of alice to be exported in both directions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if name := gatherLabel(t, e, "openvpn_server_client_bandwidth_bytes_per_second", "common_name"); name != "alice" {
+		t.Errorf("expected the bandwidth of alice, got %q", name)
+	}
+}
+
+func TestClientBandwidth(t *testing.T) {
+	b := newClientBandwidth(time.Second)
+	now := time.Date(2023, 5, 11, 16, 20, 37, 0, time.UTC)
+	b.update("0", 1000, 2000, now)
+	if _, _, ok := b.rates("0", now); ok {
+		t.Error("expected no rates after a single notification")
+	}
+	b.update("0", 3000, 6000, now.Add(2*time.Second))
+	if received, sent, ok := b.rates("0", now.Add(2*time.Second)); !ok || received != 1000 || sent != 2000 {
+		t.Errorf("expected rates of 1000 and 2000 bytes per second, got %v, %v, %v", received, sent, ok)
+	}
+	// Clients that are no longer notified are forgotten.
+	if _, _, ok := b.rates("0", now.Add(10*time.Second)); ok {
+		t.Error("expected no rates for a client that is no longer notified")
+	}
+	b.update("1", 0, 0, now.Add(10*time.Second))
+	if _, ok := b.samples["0"]; ok {
+		t.Error("expected client 0 to be forgotten")
+	}
+}
@@ -0,0 +1,94 @@
+package exporters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mmcloughlin/geohash"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoProvider reading a MaxMind DB file, such as GeoLite2 City or DB-IP
+// City Lite, which resolves addresses locally, without network access or
+// rate limits.
+type mmdbGeoProvider struct {
+	reader *maxminddb.Reader
+}
+
+// The fields of a City database record that GeoIP data is taken from.
+type mmdbRecord struct {
+	Country struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// NewMMDBGeoProvider returns a GeoProvider resolving addresses with the
+// MaxMind DB file at the given path. The database can't resolve the
+// exporter's own address, which requires the ServerAddress option or
+// another provider to fall back on.
+func NewMMDBGeoProvider(path string) (GeoProvider, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &mmdbGeoProvider{reader: reader}, nil
+}
+
+// Lookup resolves the addresses in the database. Addresses it has no
+// location for are missing from the result, without an error.
+func (p *mmdbGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	geos := map[string]GeoIP{}
+	var lastErr error
+	for _, address := range addresses {
+		if address == "" {
+			lastErr = errors.New("a MaxMind database can't resolve the exporter's own address")
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			lastErr = fmt.Errorf("invalid IP address %q", address)
+			continue
+		}
+		var record mmdbRecord
+		if err := p.reader.Lookup(ip, &record); err != nil {
+			lastErr = fmt.Errorf("looking up %s: %v", address, err)
+			continue
+		}
+		if geo, ok := mmdbGeo(address, record); ok {
+			geos[address] = geo
+		}
+	}
+	return geos, lastErr
+}
+
+// Converts a record of a City database into GeoIP data, using English
+// names. Returns false if the record holds no location.
+func mmdbGeo(address string, record mmdbRecord) (GeoIP, bool) {
+	geo := GeoIP{
+		Ip:          address,
+		CountryName: record.Country.Names["en"],
+		City:        record.City.Names["en"],
+	}
+	if len(record.Subdivisions) > 0 {
+		geo.RegionName = record.Subdivisions[0].Names["en"]
+	}
+	if latitude, longitude := record.Location.Latitude, record.Location.Longitude; latitude != nil && longitude != nil {
+		geo.Lat, geo.Lon = *latitude, *longitude
+		if validCoordinates(geo.Lat, geo.Lon) {
+			geo.Geohash = geohash.Encode(geo.Lat, geo.Lon)
+		}
+	}
+	return geo, geo.CountryName != "" || geo.Geohash != ""
+}
@@ -0,0 +1,161 @@
+package exporters
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Encodes values in the data format of MaxMind DB files, with unsigned
+// integers as uint32 and arrays as []interface{}.
+type mmdbEncoder struct {
+	data []byte
+}
+
+func (e *mmdbEncoder) control(kind byte, size int) {
+	if kind > 7 {
+		e.data = append(e.data, byte(size), kind-7)
+	} else {
+		e.data = append(e.data, kind<<5|byte(size))
+	}
+}
+
+func (e *mmdbEncoder) encode(value interface{}) {
+	switch value := value.(type) {
+	case string:
+		e.control(2, len(value))
+		e.data = append(e.data, value...)
+	case float64:
+		e.control(3, 8)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(value))
+		e.data = append(e.data, b...)
+	case uint32:
+		e.control(6, 4)
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, value)
+		e.data = append(e.data, b...)
+	case mmdbTestPointer:
+		e.data = append(e.data, 1<<5|byte(value>>8), byte(value))
+	case map[string]interface{}:
+		e.control(7, len(value))
+		for key, v := range value {
+			e.encode(key)
+			e.encode(v)
+		}
+	case []interface{}:
+		e.control(11, len(value))
+		for _, v := range value {
+			e.encode(v)
+		}
+	}
+}
+
+// Marks the start of the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Pointer to an offset of the data section.
+type mmdbTestPointer uint16
+
+// Writes an IPv6 MaxMind DB with 28 bit records, locating the IPv4
+// addresses in 203.0.113.0/24 in Amsterdam.
+func writeTestMMDB(t *testing.T) string {
+	// The data section starts with the key "names", which the record's
+	// country points to.
+	data := &mmdbEncoder{}
+	data.encode("names")
+	record := len(data.data)
+	data.data = append(data.data, 7<<5|4)
+	data.encode("country")
+	data.data = append(data.data, 7<<5|1)
+	data.encode(mmdbTestPointer(0))
+	data.encode(map[string]interface{}{"en": "Netherlands"})
+	data.encode("subdivisions")
+	data.encode([]interface{}{map[string]interface{}{"names": map[string]interface{}{"en": "North Holland"}}})
+	data.encode("city")
+	data.encode(map[string]interface{}{"names": map[string]interface{}{"en": "Amsterdam"}})
+	data.encode("location")
+	data.encode(map[string]interface{}{"latitude": 52.37, "longitude": 4.89})
+
+	// A chain of nodes follows the bits of ::203.0.113.0/120, with every
+	// other branch leading nowhere.
+	const prefixBits = 120
+	nodeCount := uint32(prefixBits)
+	prefix := [16]byte{12: 203, 13: 0, 14: 113}
+	var tree []byte
+	for i := 0; i < prefixBits; i++ {
+		next := uint32(i + 1)
+		if i == prefixBits-1 {
+			next = nodeCount + 16 + uint32(record)
+		}
+		records := [2]uint32{nodeCount, nodeCount}
+		records[prefix[i/8]>>(7-i%8)&1] = next
+		left, right := records[0], records[1]
+		tree = append(tree,
+			byte(left>>16), byte(left>>8), byte(left),
+			byte(left>>24)<<4|byte(right>>24),
+			byte(right>>16), byte(right>>8), byte(right))
+	}
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data.data...)
+	file = append(file, mmdbMetadataMarker...)
+	metadata := &mmdbEncoder{}
+	metadata.encode(map[string]interface{}{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(1700000000),
+		"database_type":               "GeoLite2-City",
+		"description":                 map[string]interface{}{"en": "Test database"},
+		"languages":                   []interface{}{"en"},
+		"node_count":                  nodeCount,
+		"record_size":                 uint32(28),
+		"ip_version":                  uint32(6),
+	})
+	file = append(file, metadata.data...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBGeoProvider(t *testing.T) {
+	p, err := NewMMDBGeoProvider(writeTestMMDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geos, err := p.Lookup(context.Background(), []string{"203.0.113.7", "::ffff:203.0.113.8", "198.51.100.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amsterdam := GeoIP{CountryName: "Netherlands", RegionName: "North Holland", City: "Amsterdam", Lat: 52.37, Lon: 4.89, Geohash: "u173zm8v3786"}
+	expected := map[string]GeoIP{}
+	for _, address := range []string{"203.0.113.7", "::ffff:203.0.113.8"} {
+		geo := amsterdam
+		geo.Ip = address
+		expected[address] = geo
+	}
+	if !reflect.DeepEqual(geos, expected) {
+		t.Errorf("expected %+v, got %+v", expected, geos)
+	}
+
+	if _, err := p.Lookup(context.Background(), []string{""}); err == nil {
+		t.Error("expected an error resolving the own address")
+	}
+}
+
+func TestMMDBGeoProviderInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMMDBGeoProvider(path); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -3,18 +3,21 @@ package exporters
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/mmcloughlin/geohash"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"io"
-	"io/ioutil"
-	"log"
-	"math"
-	"net/http"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type OpenvpnServerHeader struct {
@@ -26,81 +29,495 @@ type OpenvpnServerHeaderField struct {
 	Column    string
 	Desc      *prometheus.Desc
 	ValueType prometheus.ValueType
+	// Skip the metric when the column is empty or unparseable, instead
+	// of failing the scrape.
+	Optional bool
+	// For info metrics, which have a value of 1, the columns exported as
+	// additional labels instead of Column, unless they are label columns
+	// already. The metric is skipped when all of them are empty.
+	InfoColumns []string
 }
 
-type OpenVPNExporter struct {
-	statusPath                 string
-	geoIP *GeoIP
-	openvpnUpDesc               *prometheus.Desc
-	openvpnStatusUpdateTimeDesc *prometheus.Desc
-	openvpnConnectedClientsDesc *prometheus.Desc
-	openvpnServerHeaders        map[string]OpenvpnServerHeader
+// Options holds the optional settings of an OpenVPNExporter. The zero
+// value gives the default behaviour.
+type Options struct {
+	// Treat status files lacking the trailing END footer as truncated
+	// and report the scrape as failed.
+	RequireEnd bool
+	// Report the scrape as failed when the status was last updated
+	// longer ago than this, as happens when OpenVPN is wedged, and export
+	// whether it was. Zero disables the check.
+	StaleAfter time.Duration
+	// Format of the status: v1, v2 or v3 for server statuses, or client
+	// for client statistics. Detected from the first line by default.
+	StatusFormat string
+	// Only parse the status file when its modification time or size
+	// changed since the previous scrape, exporting the metrics of the
+	// previous scrape otherwise. Status files fetched over HTTP are only
+	// parsed when the server doesn't answer a conditional request with
+	// 304 Not Modified. Has no effect on the management interface, SSH
+	// or standard input.
+	CacheUnchangedStatus bool
+	// Permission bits that management interfaces bound to a unix domain
+	// socket may have at most, which are checked before connecting to
+	// refuse sockets that other users could write to. Zero disables the
+	// check.
+	ManagementSocketMode os.FileMode
+	// Private key authenticating to the hosts of ssh:// status paths.
+	// Defaults to the keys configured for the user running the exporter.
+	SSHIdentityFile string
+	// Password of management interfaces whose URL doesn't include one.
+	// Empty by default.
+	ManagementPassword string
+	// Interval at which management interfaces are asked to notify the
+	// byte counts of every client over a connection kept open in the
+	// background, from which the client bandwidth is exported. Zero
+	// disables the notifications.
+	ManagementBytecountInterval time.Duration
+	// Bearer token sent in the Authorization header when fetching
+	// http:// and https:// status paths. Empty by default.
+	StatusBearerToken string
+	// Export clients whose common name is UNDEF or empty, such as
+	// clients authenticating by username only or still completing their
+	// handshake, using their real address as common name. By default
+	// these are skipped.
+	IncludeUndef bool
+	// Disable all GeoIP lookups, including the one of the server's own
+	// address at startup. Geo labels are still present, but empty, and
+	// the client distance metric is omitted.
+	DisableGeoIP bool
+	// Only resolve the GeoIP data of the server, exported as server
+	// labels, leaving the geo labels of clients empty and omitting their
+	// distance and the per-country and per-region client counts.
+	ServerGeoIPOnly bool
+	// Resolve the GeoIP data of clients in the background instead of
+	// during the scrape, so that GeoIP API latency never slows scrapes
+	// down. Clients are exported without geo labels until resolved.
+	AsyncGeoIP bool
+	// Only resolve GeoIP data for clients whose received plus sent bytes
+	// exceed this amount. Zero resolves every client.
+	GeoMinBytes uint64
+	// Address ranges of clients that are never resolved, as GeoIP APIs
+	// can't locate them. Defaults to the private, shared (CGNAT),
+	// loopback and link-local ranges; an empty, non-nil slice resolves
+	// every client.
+	GeoIPExcludedPrefixes []netip.Prefix
+	// Path of a JSON file persisting the GeoIP cache across restarts,
+	// which is loaded at startup and written every minute. If writing
+	// fails, the cache is only kept in memory. Empty by default.
+	GeoCacheFile string
+	// Age after which cached GeoIP data expires, so that clients whose
+	// addresses moved or were reassigned are looked up again, including
+	// data persisted in GeoCacheFile. Defaults to a week.
+	GeoCacheTTL time.Duration
+	// Maximum number of cached addresses, beyond which the least
+	// recently used one is evicted. Defaults to 10000; a negative value
+	// disables the limit.
+	GeoCacheSize int
+	// Timeout of a single GeoIP lookup. Defaults to five seconds.
+	GeoIPTimeout time.Duration
+	// URL of the GeoIP API, in which {ip} is replaced by the address to
+	// look up, or by nothing for the server's own address, and {key} by
+	// GeoIPToken. Defaults to ip-api.com's free endpoint; ip-api.com's
+	// pro endpoint, such as https://pro.ip-api.com/json/{ip}?key={key},
+	// is queried in batches as well.
+	GeoIPURL string
+	// Names of the fields of the GeoIP API's JSON response holding the
+	// ip, country, region, city, lat and lon, or of a coordinates field
+	// holding both as "lat,lon". Fields not listed default to the names
+	// used by ip-api.com.
+	GeoIPFields map[string]string
+	// Resolves the location of addresses. Defaults to the providers
+	// named in GeoIPProviders. A GeoProviderChain falls back on further
+	// providers.
+	GeoProvider GeoProvider
+	// Names of the GeoIP providers tried in order when GeoProvider is
+	// nil: ip-api for the GeoIP API configured by GeoIPURL and
+	// GeoIPFields, ipinfo for ipinfo.io, ipstack for ipstack.com, mmdb
+	// for the MaxMind database at GeoIPDatabase, static for the
+	// locations listed in GeoIPStaticFile, or none. Defaults to ip-api.
+	GeoIPProviders []string
+	// Token authenticating requests to GeoIP APIs that require one,
+	// such as ipinfo.io's paid plans, ipstack.com's access key or the
+	// key of ip-api.com's pro endpoint.
+	GeoIPToken string
+	// Path of a MaxMind DB file, such as GeoLite2 City, used by the mmdb
+	// provider.
+	GeoIPDatabase string
+	// Path of a JSON file listing the locations of address ranges, used
+	// by the static provider, see LoadStaticGeoProvider.
+	GeoIPStaticFile string
+	// Maximum number of GeoIP lookups per minute. Defaults to 45, or no
+	// limit with ip-api.com's pro endpoint; a negative value disables
+	// rate limiting.
+	GeoIPRateLimit float64
+	// Public IP or hostname at which clients connect to the server,
+	// whose GeoIP data is exported as server labels. Defaults to the
+	// address the GeoIP API sees the exporter connect from, which
+	// differs behind NAT or on multi-homed hosts. The server location is
+	// kept per exporter, so that exporters of servers in different
+	// locations each compute client distances against their own.
+	ServerAddress string
+	// Number of times a GeoIP request failing with a network error, a
+	// server error or rate limiting is retried. Defaults to 2; a
+	// negative value disables retries.
+	GeoIPRetries int
+	// Delay before the first retry of a GeoIP request, doubling with
+	// every further retry. Defaults to half a second.
+	GeoIPRetryBackoff time.Duration
+	// Interval at which the server's own GeoIP data is looked up again,
+	// to follow changes of its public IP. Zero only looks it up once.
+	ServerGeoRefreshInterval time.Duration
+	// Omit the client distance metric.
+	DisableDistance bool
+	// Unit of the client distance metric: meters, kilometers or miles.
+	// Defaults to meters.
+	DistanceUnit string
+	// Number of characters of the server and client geohash labels,
+	// from 1 to 12. Defaults to 5, about the size of a city, which
+	// matches the accuracy of GeoIP data.
+	GeohashPrecision int
+	// Export the latitude and longitude of every resolved client as
+	// gauges. Disabled by default, as it adds two series per client.
+	ClientCoordinates bool
+	// How the identifying common_name, username and real_address client
+	// labels are exported. Labels not listed are kept as is.
+	LabelModes map[string]LabelMode
+	// Salt of the hashes of labels exported with LabelHash.
+	LabelHashSalt string
+	// Optional client labels to export, such as common_name and country,
+	// omitting all others to reduce cardinality. The server labels are
+	// always exported. Nil exports all client labels but data_channel_cipher,
+	// which duplicates the cipher info metric.
+	ClientLabels []string
+	// Omit all per-client metrics when the status lists more clients
+	// than this, to protect Prometheus from excessive cardinality. Totals
+	// and per-country and per-region counts are still exported. Zero
+	// disables the limit.
+	MaxClientSeries int
+	// Export the receive and send rate of every client, in bytes per
+	// second, computed from the byte counts of consecutive scrapes.
+	ClientRates bool
+	// Export the bytes received and sent by every common name over all
+	// of its sessions, which keep growing across reconnects and server
+	// restarts. The totals of every common name ever seen are retained
+	// until the exporter restarts, so memory grows with the number of
+	// distinct common names. Requires the common_name label.
+	ClientLifetimeTotals bool
+	// Names of extra labels describing the server, such as its
+	// datacenter or environment, which follow the built-in server labels
+	// and whose values are given by the Labels of every status source.
+	// Defaults to the labels of the status sources.
+	ServerLabels []string
+	// Time after which collecting a status source is given up on and
+	// reported as failed with the reason timeout, even when reading it is
+	// stuck, as on a hung NFS mount. Sources may set their own Timeout.
+	// Zero disables the timeout, leaving sources to be limited by the
+	// scrape timeout of Prometheus.
+	SourceTimeout time.Duration
+	// Maximum number of status sources collected at once, so that a
+	// slow source, such as a status file on a hung NFS mount, doesn't
+	// delay the others. Defaults to 8; 1 collects them one by one.
+	SourceConcurrency int
+	// Receives log messages. Defaults to discarding them.
+	Logger Logger
+	// Name identifying the status source of NewOpenVPNExporter in the
+	// server_name label. Defaults to the status path.
+	ServerName string
+	// Namespace prefixing the name of every metric. Defaults to openvpn.
+	Namespace string
+	// Subsystem inserted after the namespace in the name of every
+	// metric, such that openvpn_up becomes openvpn_<subsystem>_up.
+	// Empty by default.
+	Subsystem string
 }
 
-type GeoIP struct {
-	Ip          string  `json:"query"`
-	CountryName string  `json:"country"`
-	RegionName  string  `json:"regionName"`
-	City        string  `json:"city"`
-	Lat         float64 `json:"lat"`
-	Lon         float64 `json:"lon"`
-	Geohash     string
+// Returns the fully-qualified name of a metric, prefixed with the
+// configured namespace and subsystem.
+func (o Options) fqName(subsystem string, name string) string {
+	namespace := o.Namespace
+	if o.Subsystem != "" {
+		namespace = prometheus.BuildFQName(o.Namespace, "", o.Subsystem)
+	}
+	return prometheus.BuildFQName(namespace, subsystem, name)
 }
 
-var geoCache = map[string]GeoIP{}
+// Error returned when collecting a status source fails, carrying a short
+// reason that is exported as a label of openvpn_collect_error.
+type collectError struct {
+	reason string
+	err    error
+}
 
-func getGeo(address string) (GeoIP, error) {
-	geo := GeoIP{}
-	if val, ok := geoCache[address]; ok {
-		return val, nil
-	}
+func (e *collectError) Error() string {
+	return e.err.Error()
+}
 
-	log.Printf("Resolving %s", address)
+func (e *collectError) Unwrap() error {
+	return e.err
+}
 
-	response, err := http.Get("http://ip-api.com/json/" + address)
-	if err != nil {
-		return geo, err
-	}
-	defer response.Body.Close()
+// Error returned for status files lacking the END footer when it is
+// required.
+var errTruncated = &collectError{reason: "truncated", err: errors.New("status file lacks END footer, possibly truncated")}
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return geo, err
+// Returns the reason of a collect failure. Errors not classified
+// otherwise stem from parsing the status.
+func collectErrorReason(err error) string {
+	var ce *collectError
+	if errors.As(err, &ce) {
+		return ce.reason
 	}
+	return "parse"
+}
 
-	err = json.Unmarshal(body, &geo)
-	if err != nil {
-		return geo, err
-	}
+type OpenVPNExporter struct {
+	// Status sources, replaced by SetStatusSources.
+	sourcesMutex sync.RWMutex
+	sources      []*statusSource
+	options      Options
+	logger       Logger
+	geoProvider  GeoProvider
+	// Context of the background GeoIP lookups, cancelled by Close.
+	backgroundCtx   context.Context
+	stopBackground  context.CancelFunc
+	background      sync.WaitGroup
+	geoCache        *geoIPCache
+	geoCacheFile    *geoCacheFile
+	geoIPMutex      sync.RWMutex
+	geoQueue        chan []string
+	geoPendingMutex sync.Mutex
+	geoPending      map[string]bool
+	geoIP           GeoIP
+	// Columns of status HEADER lines unknown to the exporter, which
+	// are logged once.
+	unknownColumnsMutex              sync.Mutex
+	unknownColumns                   map[string]bool
+	openvpnUpDesc                    *prometheus.Desc
+	openvpnStatusUpdateTimeDesc      *prometheus.Desc
+	openvpnStatusAgeDesc             *prometheus.Desc
+	openvpnStatusStaleDesc           *prometheus.Desc
+	openvpnServerInfoDesc            *prometheus.Desc
+	openvpnConnectedClientsDesc      *prometheus.Desc
+	openvpnClientsByCountryDesc      *prometheus.Desc
+	openvpnClientsByRegionDesc       *prometheus.Desc
+	openvpnCollectSuccessDesc        *prometheus.Desc
+	openvpnCollectErrorDesc          *prometheus.Desc
+	openvpnScrapeDurationDesc        *prometheus.Desc
+	openvpnManagementAuthFailedDesc  *prometheus.Desc
+	openvpnClientConnectionsDesc     *prometheus.Desc
+	openvpnClientSeriesTruncatedDesc *prometheus.Desc
+	openvpnLifetimeReceivedDesc      *prometheus.Desc
+	openvpnLifetimeSentDesc          *prometheus.Desc
+	openvpnServerHeaders             map[string]OpenvpnServerHeader
+	openvpnClientDescs               map[string]*prometheus.Desc
+	openvpnGlobalStatsDescs          map[string]*prometheus.Desc
+	openvpnGlobalStatDesc            *prometheus.Desc
+	hashedColumns                    map[string]bool
+	statusParseErrors                prometheus.Counter
+	geoIPLookupFailures              prometheus.Counter
+	geoIPLookupsDeferred             prometheus.Counter
+	geoIPCacheHits                   prometheus.Counter
+	geoIPCacheMisses                 prometheus.Counter
+	geoIPCacheEvictions              prometheus.Counter
+	geoIPResolutionDuration          prometheus.Histogram
+}
 
-	geo.Geohash = geohash.Encode(geo.Lat, geo.Lon)
+// Labels describing the server, attached to every metric.
+var serverLabels = []string{"server_name", "server_geohash", "server_city", "server_country", "server_region", "server_public_ip"}
 
-	geoCache[address] = geo
+// Returns the server labels, including the extra ones of the options,
+// followed by the given labels.
+func (o Options) withServerLabels(labels ...string) []string {
+	return append(append(append([]string{}, serverLabels...), o.ServerLabels...), labels...)
+}
 
-	return geo, nil
+// NewOpenVPNExporter returns an exporter of a single status file or
+// management interface, named by the ServerName option.
+func NewOpenVPNExporter(statusPath string, options Options) (*OpenVPNExporter, error) {
+	return NewMultiOpenVPNExporter([]StatusSource{{Path: statusPath, Name: options.ServerName}}, options)
 }
 
-func NewOpenVPNExporter(statusPath string) (*OpenVPNExporter, error) {
+// NewMultiOpenVPNExporter returns an exporter of several status files or
+// management interfaces, such as those of OpenVPN instances running side
+// by side, whose metrics are told apart by the server_name label. The
+// ServerName option is ignored.
+func NewMultiOpenVPNExporter(sources []StatusSource, options Options) (*OpenVPNExporter, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no status sources given")
+	}
+	if options.Namespace == "" {
+		options.Namespace = "openvpn"
+	}
+	if name := options.fqName("", "up"); !model.IsValidMetricName(model.LabelValue(name)) {
+		return nil, fmt.Errorf("invalid metric namespace or subsystem: %q", name)
+	}
+	if options.DistanceUnit == "" {
+		options.DistanceUnit = "meters"
+	}
+	if _, ok := distanceUnits[options.DistanceUnit]; !ok {
+		return nil, fmt.Errorf("unknown distance unit: %q", options.DistanceUnit)
+	}
+	if options.ServerLabels == nil {
+		options.ServerLabels = sourceLabelNames(sources)
+	}
+	if err := validateServerLabels(options.ServerLabels); err != nil {
+		return nil, err
+	}
+	serverLabels := options.withServerLabels()
+
 	// Metrics exported both for client and server statistics.
 	openvpnUpDesc := prometheus.NewDesc(
-		prometheus.BuildFQName("openvpn", "", "up"),
+		options.fqName("", "up"),
 		"Whether scraping OpenVPN's metrics was successful.",
-		[]string{"server_geohash", "server_city", "server_country", "server_region", "server_public_ip"}, nil)
+		serverLabels, nil)
 	openvpnStatusUpdateTimeDesc := prometheus.NewDesc(
-		prometheus.BuildFQName("openvpn", "", "status_update_time_seconds"),
+		options.fqName("", "status_update_time_seconds"),
 		"UNIX timestamp at which the OpenVPN statistics were updated.",
-		[]string{"server_geohash", "server_city", "server_country", "server_region", "server_public_ip"}, nil)
+		serverLabels, nil)
+	openvpnServerInfoDesc := prometheus.NewDesc(
+		options.fqName("server", "info"),
+		"Version of the OpenVPN server, as named in the title of its status.",
+		options.withServerLabels("version"), nil)
+	openvpnCollectSuccessDesc := prometheus.NewDesc(
+		options.fqName("", "collect_success"),
+		"Whether collecting the status source was successful.",
+		[]string{"server_name"}, nil)
+	openvpnScrapeDurationDesc := prometheus.NewDesc(
+		options.fqName("", "scrape_duration_seconds"),
+		"Time it took to collect the status source, including GeoIP resolution.",
+		[]string{"server_name"}, nil)
+	openvpnCollectErrorDesc := prometheus.NewDesc(
+		options.fqName("", "collect_error"),
+		"Set when collecting the status source failed, labeled with the reason.",
+		[]string{"server_name", "reason"}, nil)
+
+	// Metrics specific to OpenVPN clients.
+	openvpnClientDescs := map[string]*prometheus.Desc{
+		"TUN/TAP read bytes": prometheus.NewDesc(
+			options.fqName("client", "tun_tap_read_bytes_total"),
+			"Total amount of TUN/TAP traffic read, in bytes.",
+			serverLabels, nil),
+		"TUN/TAP write bytes": prometheus.NewDesc(
+			options.fqName("client", "tun_tap_write_bytes_total"),
+			"Total amount of TUN/TAP traffic written, in bytes.",
+			serverLabels, nil),
+		"TCP/UDP read bytes": prometheus.NewDesc(
+			options.fqName("client", "tcp_udp_read_bytes_total"),
+			"Total amount of TCP/UDP traffic read, in bytes.",
+			serverLabels, nil),
+		"TCP/UDP write bytes": prometheus.NewDesc(
+			options.fqName("client", "tcp_udp_write_bytes_total"),
+			"Total amount of TCP/UDP traffic written, in bytes.",
+			serverLabels, nil),
+		"Auth read bytes": prometheus.NewDesc(
+			options.fqName("client", "auth_read_bytes_total"),
+			"Total amount of authentication traffic read, in bytes.",
+			serverLabels, nil),
+		"pre-compress bytes": prometheus.NewDesc(
+			options.fqName("client", "pre_compress_bytes_total"),
+			"Total amount of data before compression, in bytes.",
+			serverLabels, nil),
+		"post-compress bytes": prometheus.NewDesc(
+			options.fqName("client", "post_compress_bytes_total"),
+			"Total amount of data after compression, in bytes.",
+			serverLabels, nil),
+		"pre-decompress bytes": prometheus.NewDesc(
+			options.fqName("client", "pre_decompress_bytes_total"),
+			"Total amount of data before decompression, in bytes.",
+			serverLabels, nil),
+		"post-decompress bytes": prometheus.NewDesc(
+			options.fqName("client", "post_decompress_bytes_total"),
+			"Total amount of data after decompression, in bytes.",
+			serverLabels, nil),
+	}
 
 	// Metrics specific to OpenVPN servers.
 	openvpnConnectedClientsDesc := prometheus.NewDesc(
-		prometheus.BuildFQName("openvpn", "", "server_connected_clients"),
+		options.fqName("", "server_connected_clients"),
 		"Number Of Connected Clients",
-		[]string{"server_geohash", "server_city", "server_country", "server_region", "server_public_ip"}, nil)
+		serverLabels, nil)
+	openvpnClientsByCountryDesc := prometheus.NewDesc(
+		options.fqName("", "server_connected_clients_by_country"),
+		"Number of connected clients per country they connect from.",
+		options.withServerLabels("country"), nil)
+	openvpnClientsByRegionDesc := prometheus.NewDesc(
+		options.fqName("", "server_connected_clients_by_region"),
+		"Number of connected clients per region they connect from.",
+		options.withServerLabels("country", "region"), nil)
+
+	openvpnGlobalStatsDescs := map[string]*prometheus.Desc{
+		"Max bcast/mcast queue length": prometheus.NewDesc(
+			options.fqName("server", "max_bcast_mcast_queue_length"),
+			"Maximum length of the broadcast/multicast queue.",
+			serverLabels, nil),
+		"dco_enabled": prometheus.NewDesc(
+			options.fqName("server", "dco_enabled"),
+			"Whether data channel offload to the kernel is enabled.",
+			serverLabels, nil),
+		"Bytes Received": prometheus.NewDesc(
+			options.fqName("server", "received_bytes"),
+			"Amount of data received by the VPN server, in bytes.",
+			serverLabels, nil),
+		"Bytes Sent": prometheus.NewDesc(
+			options.fqName("server", "sent_bytes"),
+			"Amount of data sent by the VPN server, in bytes.",
+			serverLabels, nil),
+	}
+
+	if err := validateStatusFormat(options.StatusFormat); err != nil {
+		return nil, err
+	}
+	if err := validateLabelModes(options.LabelModes); err != nil {
+		return nil, err
+	}
+	labelModes, err := selectClientLabels(options.LabelModes, options.ClientLabels)
+	if err != nil {
+		return nil, err
+	}
+	options.LabelModes = labelModes
+	clientLabels, serverHeaderClientLabelColumns, hashedColumns := applyLabelModes(options.LabelModes,
+		[]string{"common_name", "connection_time", "real_address", "virtual_address", "virtual_ipv6_address", "username", "client_id", "peer_id", "data_channel_cipher", "geohash", "city", "country", "region"},
+		[]string{"Common Name", "Connected Since (time_t)", "Real Address", "Virtual Address", "Virtual IPv6 Address", "Username", "Client ID", "Peer ID", "Data Channel Cipher", "Geohash", "City", "Country", "Region"})
+	serverHeaderClientLabels := options.withServerLabels(clientLabels...)
+	routingLabels, serverHeaderRoutingLabelColumns, _ := applyLabelModes(options.LabelModes,
+		[]string{"common_name", "real_address", "virtual_address", "username", "geohash", "city", "country", "region"},
+		[]string{"Common Name", "Real Address", "Virtual Address", "Username", "Geohash", "City", "Country", "Region"})
+	serverHeaderRoutingLabels := options.withServerLabels(routingLabels...)
+	// The info metrics carry the cipher as a label of their own, unless
+	// the client metrics already do.
+	cipherInfoLabels := append([]string{}, serverHeaderClientLabels...)
+	clientInfoLabels := append([]string{}, serverHeaderClientLabels...)
+	if options.LabelModes["data_channel_cipher"] == LabelDrop {
+		cipherInfoLabels = append(cipherInfoLabels, "data_channel_cipher")
+		clientInfoLabels = append(clientInfoLabels, "cipher")
+	}
+	clientInfoLabels = append(clientInfoLabels, "tls_version")
 
-	serverHeaderClientLabels := []string{"server_geohash", "server_city", "server_country", "server_region", "server_public_ip", "common_name", "connection_time", "real_address", "virtual_address", "username", "geohash", "city", "country", "region"}
-	serverHeaderClientLabelColumns := []string{"Common Name", "Connected Since (time_t)", "Real Address", "Virtual Address", "Username", "Geohash", "City", "Country", "Region"}
-	serverHeaderRoutingLabels := []string{"server_geohash", "server_city", "server_country", "server_region", "server_public_ip", "common_name", "real_address", "virtual_address", "username", "geohash", "city", "country", "region"}
-	serverHeaderRoutingLabelColumns := []string{"Common Name", "Real Address", "Virtual Address", "Username", "Geohash", "City", "Country", "Region"}
+	// Sessions per common name, unless common names are dropped.
+	var openvpnClientConnectionsDesc *prometheus.Desc
+	if options.LabelModes["common_name"] != LabelDrop {
+		openvpnClientConnectionsDesc = prometheus.NewDesc(
+			options.fqName("server", "client_connections"),
+			"Number of sessions using a common name, from distinct real addresses. More than one means the same certificate is connected multiple times.",
+			options.withServerLabels("common_name"), nil)
+	}
+
+	// Cumulative traffic per common name, across sessions.
+	var openvpnLifetimeReceivedDesc, openvpnLifetimeSentDesc *prometheus.Desc
+	if options.ClientLifetimeTotals {
+		if options.LabelModes["common_name"] == LabelDrop {
+			return nil, errors.New("client lifetime totals require the common_name label")
+		}
+		openvpnLifetimeReceivedDesc = prometheus.NewDesc(
+			options.fqName("server", "client_lifetime_received_bytes_total"),
+			"Amount of data received from a common name over all of its sessions since the exporter started, in bytes.",
+			options.withServerLabels("common_name"), nil)
+		openvpnLifetimeSentDesc = prometheus.NewDesc(
+			options.fqName("server", "client_lifetime_sent_bytes_total"),
+			"Amount of data sent to a common name over all of its sessions since the exporter started, in bytes.",
+			options.withServerLabels("common_name"), nil)
+	}
 
 	openvpnServerHeaders := map[string]OpenvpnServerHeader{
 		"CLIENT_LIST": {
@@ -109,7 +526,7 @@ func NewOpenVPNExporter(statusPath string) (*OpenVPNExporter, error) {
 				{
 					Column: "Bytes Received",
 					Desc: prometheus.NewDesc(
-						prometheus.BuildFQName("openvpn", "server", "client_received_bytes_total"),
+						options.fqName("server", "client_received_bytes_total"),
 						"Amount of data received over a connection on the VPN server, in bytes.",
 						serverHeaderClientLabels, nil),
 					ValueType: prometheus.CounterValue,
@@ -117,18 +534,45 @@ func NewOpenVPNExporter(statusPath string) (*OpenVPNExporter, error) {
 				{
 					Column: "Bytes Sent",
 					Desc: prometheus.NewDesc(
-						prometheus.BuildFQName("openvpn", "server", "client_sent_bytes_total"),
+						options.fqName("server", "client_sent_bytes_total"),
 						"Amount of data sent over a connection on the VPN server, in bytes.",
 						serverHeaderClientLabels, nil),
 					ValueType: prometheus.CounterValue,
 				},
 				{
-					Column: "Distance From Server",
+					Column: "Connected Since (time_t)",
+					Desc: prometheus.NewDesc(
+						options.fqName("server", "client_connected_since_seconds"),
+						"Time at which the client connected, in seconds.",
+						serverHeaderClientLabels, nil),
+					ValueType: prometheus.GaugeValue,
+					Optional:  true,
+				},
+				{
+					// Derived from the routing table.
+					Column: "Last Seen",
 					Desc: prometheus.NewDesc(
-						prometheus.BuildFQName("openvpn", "server", "client_distance"),
-						"Distance from server to client, in meters",
+						options.fqName("server", "client_last_seen_seconds"),
+						"Time at which the client last sent traffic through any of its routes, in seconds.",
 						serverHeaderClientLabels, nil),
 					ValueType: prometheus.GaugeValue,
+					Optional:  true,
+				},
+				{
+					InfoColumns: []string{"Data Channel Cipher"},
+					Desc: prometheus.NewDesc(
+						options.fqName("server", "client_data_channel_cipher_info"),
+						"Data channel cipher negotiated with the client.",
+						cipherInfoLabels, nil),
+					ValueType: prometheus.GaugeValue,
+				},
+				{
+					InfoColumns: []string{"Data Channel Cipher", "TLS Version"},
+					Desc: prometheus.NewDesc(
+						options.fqName("server", "client_info"),
+						"Security parameters negotiated with the client, as far as the server lists them.",
+						clientInfoLabels, nil),
+					ValueType: prometheus.GaugeValue,
 				},
 			},
 		},
@@ -138,7 +582,7 @@ func NewOpenVPNExporter(statusPath string) (*OpenVPNExporter, error) {
 				{
 					Column: "Last Ref (time_t)",
 					Desc: prometheus.NewDesc(
-						prometheus.BuildFQName("openvpn", "server", "route_last_reference_time_seconds"),
+						options.fqName("server", "route_last_reference_time_seconds"),
 						"Time at which a route was last referenced, in seconds.",
 						serverHeaderRoutingLabels, nil),
 					ValueType: prometheus.GaugeValue,
@@ -146,261 +590,1149 @@ func NewOpenVPNExporter(statusPath string) (*OpenVPNExporter, error) {
 			},
 		},
 	}
+	if !options.DisableDistance {
+		clientList := openvpnServerHeaders["CLIENT_LIST"]
+		clientList.Metrics = append(clientList.Metrics, OpenvpnServerHeaderField{
+			Column: "Distance From Server",
+			Desc: prometheus.NewDesc(
+				options.fqName("server", "client_distance"),
+				"Distance from server to client, in "+options.DistanceUnit,
+				serverHeaderClientLabels, nil),
+			ValueType: prometheus.GaugeValue,
+		})
+		openvpnServerHeaders["CLIENT_LIST"] = clientList
+	}
+	if options.ClientCoordinates {
+		// Per-client coordinates, for plotting clients on a map.
+		clientList := openvpnServerHeaders["CLIENT_LIST"]
+		clientList.Metrics = append(clientList.Metrics,
+			OpenvpnServerHeaderField{
+				Column: "Latitude",
+				Desc: prometheus.NewDesc(
+					options.fqName("server", "client_latitude"),
+					"Latitude of the client's resolved location, in degrees.",
+					serverHeaderClientLabels, nil),
+				ValueType: prometheus.GaugeValue,
+			},
+			OpenvpnServerHeaderField{
+				Column: "Longitude",
+				Desc: prometheus.NewDesc(
+					options.fqName("server", "client_longitude"),
+					"Longitude of the client's resolved location, in degrees.",
+					serverHeaderClientLabels, nil),
+				ValueType: prometheus.GaugeValue,
+			})
+		openvpnServerHeaders["CLIENT_LIST"] = clientList
+	}
+	if options.ClientRates {
+		// Per-client throughput, derived from the previous scrape.
+		clientList := openvpnServerHeaders["CLIENT_LIST"]
+		clientList.Metrics = append(clientList.Metrics,
+			OpenvpnServerHeaderField{
+				Column: "Receive Rate",
+				Desc: prometheus.NewDesc(
+					options.fqName("server", "client_receive_bytes_per_second"),
+					"Rate at which data was received over a connection since the previous scrape, in bytes per second.",
+					serverHeaderClientLabels, nil),
+				ValueType: prometheus.GaugeValue,
+			},
+			OpenvpnServerHeaderField{
+				Column: "Send Rate",
+				Desc: prometheus.NewDesc(
+					options.fqName("server", "client_send_bytes_per_second"),
+					"Rate at which data was sent over a connection since the previous scrape, in bytes per second.",
+					serverHeaderClientLabels, nil),
+				ValueType: prometheus.GaugeValue,
+			})
+		openvpnServerHeaders["CLIENT_LIST"] = clientList
+	}
 
-	geo, err := getGeo("")
-	if err != nil {
-		log.Printf("Error getting server geo %v", err)
+	if options.ManagementBytecountInterval > 0 {
+		// Per-client throughput, notified by management interfaces.
+		clientList := openvpnServerHeaders["CLIENT_LIST"]
+		for _, field := range []struct{ column, direction string }{
+			{"Bandwidth Received", "received"},
+			{"Bandwidth Sent", "sent"},
+		} {
+			clientList.Metrics = append(clientList.Metrics, OpenvpnServerHeaderField{
+				Column: field.column,
+				Desc: prometheus.NewDesc(
+					options.fqName("server", "client_bandwidth_bytes_per_second"),
+					"Rate at which data is transferred over a connection, in bytes per second, as notified by the management interface.",
+					serverHeaderClientLabels, prometheus.Labels{"direction": field.direction}),
+				ValueType: prometheus.GaugeValue,
+			})
+		}
+		openvpnServerHeaders["CLIENT_LIST"] = clientList
+	}
+
+	if options.GeoIPRateLimit == 0 {
+		options.GeoIPRateLimit = defaultGeoIPRateLimit
+		if isIPAPIPro(options.GeoIPURL) {
+			options.GeoIPRateLimit = -1
+		}
+	}
+	if options.Logger == nil {
+		options.Logger = nopLogger{}
+	}
+	if options.SourceConcurrency == 0 {
+		options.SourceConcurrency = defaultSourceConcurrency
 	}
-	return &OpenVPNExporter{
-		statusPath:                 statusPath,
-		geoIP: &geo,
+	if options.SourceConcurrency < 0 {
+		return nil, fmt.Errorf("source concurrency must be positive: %d", options.SourceConcurrency)
+	}
+	if options.GeoIPTimeout == 0 {
+		options.GeoIPTimeout = defaultGeoIPTimeout
+	}
+	if options.GeoCacheTTL == 0 {
+		options.GeoCacheTTL = defaultGeoCacheTTL
+	}
+	if options.GeoCacheSize == 0 {
+		options.GeoCacheSize = defaultGeoCacheSize
+	}
+	if options.GeohashPrecision == 0 {
+		options.GeohashPrecision = defaultGeohashPrecision
+	}
+	if options.GeohashPrecision < 1 || options.GeohashPrecision > maxGeohashPrecision {
+		return nil, fmt.Errorf("geohash precision must be between 1 and %d: %d", maxGeohashPrecision, options.GeohashPrecision)
+	}
+	if options.GeoIPExcludedPrefixes == nil {
+		options.GeoIPExcludedPrefixes = defaultGeoIPExcludedPrefixes
+	}
+	if options.GeoIPRetries == 0 {
+		options.GeoIPRetries = defaultGeoIPRetries
+	}
+	if options.GeoIPRetryBackoff == 0 {
+		options.GeoIPRetryBackoff = defaultGeoIPRetryBackoff
+	}
+	if options.GeoIPURL == "" {
+		options.GeoIPURL = defaultGeoIPURL
+	}
+	if len(options.GeoIPProviders) == 0 {
+		options.GeoIPProviders = []string{"ip-api"}
+	}
+	if options.GeoProvider == nil {
+		provider, err := newGeoProvider(options)
+		if err != nil {
+			return nil, err
+		}
+		options.GeoProvider = provider
+	}
+	e := &OpenVPNExporter{
+		options:                     options,
+		logger:                      options.Logger,
+		geoProvider:                 options.GeoProvider,
 		openvpnUpDesc:               openvpnUpDesc,
 		openvpnStatusUpdateTimeDesc: openvpnStatusUpdateTimeDesc,
+		openvpnStatusAgeDesc: prometheus.NewDesc(
+			options.fqName("", "status_age_seconds"),
+			"Time since the OpenVPN statistics were updated, in seconds.",
+			serverLabels, nil),
+		openvpnStatusStaleDesc: prometheus.NewDesc(
+			options.fqName("", "status_stale"),
+			"Whether the OpenVPN statistics were updated longer ago than the staleness threshold.",
+			serverLabels, nil),
+		openvpnServerInfoDesc:       openvpnServerInfoDesc,
 		openvpnConnectedClientsDesc: openvpnConnectedClientsDesc,
+		openvpnClientsByCountryDesc: openvpnClientsByCountryDesc,
+		openvpnClientsByRegionDesc:  openvpnClientsByRegionDesc,
+		openvpnCollectSuccessDesc:   openvpnCollectSuccessDesc,
+		openvpnCollectErrorDesc:     openvpnCollectErrorDesc,
+		openvpnScrapeDurationDesc:   openvpnScrapeDurationDesc,
+		openvpnManagementAuthFailedDesc: prometheus.NewDesc(
+			options.fqName("management", "auth_failed"),
+			"Whether the management interface rejected the password, or asked for one when none is configured.",
+			[]string{"server_name"}, nil),
+		openvpnClientConnectionsDesc: openvpnClientConnectionsDesc,
+		openvpnClientSeriesTruncatedDesc: prometheus.NewDesc(
+			options.fqName("", "client_series_truncated"),
+			"Whether per-client metrics were omitted, as the number of clients exceeded the configured limit.",
+			serverLabels, nil),
+		openvpnLifetimeReceivedDesc: openvpnLifetimeReceivedDesc,
+		openvpnLifetimeSentDesc:     openvpnLifetimeSentDesc,
 		openvpnServerHeaders:        openvpnServerHeaders,
-	}, nil
-}
-
-// Converts OpenVPN status information into Prometheus metrics. This
-// function automatically detects whether the file contains server or
-// client metrics. For server metrics, it also distinguishes between the
-// version 2 and 3 file formats.
-func (e *OpenVPNExporter) collectStatusFromReader(statusPath string, file io.Reader, ch chan<- prometheus.Metric) error {
-	reader := bufio.NewReader(file)
-	buf, _ := reader.Peek(18)
-	if bytes.HasPrefix(buf, []byte("TITLE,")) {
-		// Server statistics, using format version 2.
-		return e.collectServerStatusFromReader(reader, ch, ",")
-	} else if bytes.HasPrefix(buf, []byte("TITLE\t")) {
-		// Server statistics, using format version 3. The only
-		// difference compared to version 2 is that it uses tabs
-		// instead of spaces.
-		return e.collectServerStatusFromReader(reader, ch, "\t")
-	} else if bytes.HasPrefix(buf, []byte("OpenVPN STATISTICS")) {
-		// Client statistics.
-		return fmt.Errorf("client status not supported in this fork")
-	} else {
-		return fmt.Errorf("unexpected file contents: %q", buf)
+		openvpnClientDescs:          openvpnClientDescs,
+		openvpnGlobalStatsDescs:     openvpnGlobalStatsDescs,
+		openvpnGlobalStatDesc: prometheus.NewDesc(
+			options.fqName("server", "global_stat"),
+			"Numeric GLOBAL_STATS value of the server without a metric of its own, labeled with its key.",
+			options.withServerLabels("key"), nil),
+		hashedColumns: hashedColumns,
+		statusParseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "status_parse_errors_total",
+			Help:      "Number of malformed status lines that were skipped.",
+		}),
+		geoIPLookupFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "geoip_lookup_failures_total",
+			Help:      "Number of GeoIP lookups that failed.",
+		}),
+		geoIPLookupsDeferred: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "geoip_lookups_deferred_total",
+			Help:      "Number of GeoIP lookups deferred to a later scrape by the rate limit.",
+		}),
+		geoIPCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "geoip_cache_hits_total",
+			Help:      "Number of GeoIP lookups answered from the cache.",
+		}),
+		geoIPCacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "geoip_cache_misses_total",
+			Help:      "Number of GeoIP lookups not found in the cache.",
+		}),
+		geoIPCacheEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "geoip_cache_evictions_total",
+			Help:      "Number of cached GeoIP entries evicted to make room for new ones.",
+		}),
+		geoIPResolutionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      "geoip_resolution_duration_seconds",
+			Help:      "Time spent resolving the GeoIP data of clients during a scrape.",
+		}),
 	}
-}
 
-func hsin(theta float64) float64 {
-	return math.Pow(math.Sin(theta/2), 2)
+	e.geoCache = newGeoIPCache(options.GeoCacheTTL, options.GeoCacheSize)
+	e.geoCache.evictions = e.geoIPCacheEvictions
+	e.backgroundCtx, e.stopBackground = context.WithCancel(context.Background())
+	if err := e.SetStatusSources(sources); err != nil {
+		return nil, err
+	}
+	if !options.DisableGeoIP {
+		if options.GeoCacheFile != "" {
+			e.geoCacheFile = newGeoCacheFile(options.GeoCacheFile, options.GeoCacheTTL, e.geoCache, options.Logger)
+			e.geoCacheFile.load()
+			// Writing right away reports an unwritable file at startup.
+			e.geoCacheFile.flush()
+			e.background.Add(1)
+			go e.flushGeoCachePeriodically()
+		}
+		if options.AsyncGeoIP {
+			e.geoQueue = make(chan []string, geoQueueSize)
+			e.geoPending = map[string]bool{}
+			e.background.Add(1)
+			go e.resolveQueuedGeo()
+		}
+		e.refreshServerGeo()
+		if options.ServerGeoRefreshInterval > 0 {
+			e.background.Add(1)
+			go e.refreshServerGeoPeriodically(options.ServerGeoRefreshInterval)
+		}
+	}
+	return e, nil
 }
 
-func distance(lat1, lon1, lat2, lon2 float64) float64 {
-	var la1, lo1, la2, lo2, r float64
-	la1 = lat1 * math.Pi / 180
-	lo1 = lon1 * math.Pi / 180
-	la2 = lat2 * math.Pi / 180
-	lo2 = lon2 * math.Pi / 180
-
-	r = 6378100 // Earth radius in METERS
-
-	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
-
-	return 2 * r * math.Asin(math.Sqrt(h))
+// Converts OpenVPN status information into Prometheus metrics. Unless
+// the format is configured, this function automatically detects whether
+// the file contains server or client metrics. For server metrics, it
+// also distinguishes between the version 1, 2 and 3 file formats.
+func (e *OpenVPNExporter) collectStatusFromReader(ctx context.Context, source *statusSource, file io.Reader, ch chan<- prometheus.Metric) error {
+	reader := newStatusReader(file)
+	format := e.options.StatusFormat
+	if buf, _ := reader.Peek(18); format == StatusFormatClient || (format == StatusFormatAuto && bytes.HasPrefix(buf, []byte("OpenVPN STATISTICS"))) {
+		// Client statistics.
+		return e.collectClientStatusFromReader(source, reader, ch)
+	}
+	status, err := parseServerStatus(ctx, reader, e.options.StatusFormat, e.skipMalformedLine)
+	if err != nil {
+		return err
+	}
+	return e.collectServerStatus(ctx, source, status, ch)
 }
 
-// Converts OpenVPN server status information into Prometheus metrics.
-func (e *OpenVPNExporter) collectServerStatusFromReader(file io.Reader, ch chan<- prometheus.Metric, separator string) error {
+// Converts OpenVPN client status information into Prometheus metrics.
+func (e *OpenVPNExporter) collectClientStatusFromReader(source *statusSource, file io.Reader, ch chan<- prometheus.Metric) error {
 	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	headersFound := map[string][]string{}
-	// counter of connected client
-	numberConnectedClient := 0
-
-	recordedMetrics := map[OpenvpnServerHeaderField][]string{}
-
+	scanner.Split(scanStatusLines)
+	endFound := false
+	var updateTime time.Time
 	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), separator)
+		fields := strings.Split(scanner.Text(), ",")
 		if fields[0] == "END" && len(fields) == 1 {
 			// Stats footer.
-		} else if fields[0] == "GLOBAL_STATS" {
-			// Global server statistics.
-		} else if fields[0] == "HEADER" && len(fields) > 2 {
-			// Column names for CLIENT_LIST and ROUTING_TABLE.
-			headersFound[fields[1]] = fields[2:]
-		} else if fields[0] == "TIME" && len(fields) == 3 {
+			endFound = true
+		} else if fields[0] == "OpenVPN STATISTICS" && len(fields) == 1 {
+			// Stats header.
+		} else if fields[0] == "Updated" && len(fields) == 2 {
 			// Time at which the statistics were updated.
-			timeStartStats, err := strconv.ParseFloat(fields[2], 64)
+			timeParser, err := parseStatusTime(fields[1])
 			if err != nil {
-				return err
+				e.skipMalformedLine(err)
+				continue
 			}
+			updateTime = timeParser
 			ch <- prometheus.MustNewConstMetric(
 				e.openvpnStatusUpdateTimeDesc,
 				prometheus.GaugeValue,
-				timeStartStats,
-				e.geoIP.Geohash,
-				e.geoIP.City,
-				e.geoIP.CountryName,
-				e.geoIP.RegionName,
-				e.geoIP.Ip)
-		} else if fields[0] == "TITLE" && len(fields) == 2 {
-			// OpenVPN version number.
-		} else if header, ok := e.openvpnServerHeaders[fields[0]]; ok {
-			// Entry that depends on a preceding HEADERS directive.
-			columnNames, ok := headersFound[fields[0]]
-			if !ok {
-				return fmt.Errorf("%s should be preceded by HEADERS", fields[0])
-			}
-			if len(fields) != len(columnNames)+1 {
-				return fmt.Errorf("HEADER for %s describes a different number of columns", fields[0])
+				float64(timeParser.Unix()),
+				e.serverLabelValues(source)...)
+		} else if desc, ok := e.openvpnClientDescs[fields[0]]; ok && len(fields) == 2 {
+			// Traffic counters.
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				e.skipMalformedLine(err)
+				continue
 			}
+			ch <- prometheus.MustNewConstMetric(
+				desc,
+				prometheus.CounterValue,
+				value,
+				e.serverLabelValues(source)...)
+		} else if len(fields) == 2 {
+			// Other counters, which newer versions may add.
+			e.logger.Debugf("Skipping unknown client statistic: %q", fields[0])
+		} else {
+			e.skipMalformedLine(fmt.Errorf("unsupported key: %q", fields[0]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if e.options.RequireEnd && !endFound {
+		return errTruncated
+	}
+	return e.collectStatusAge(source, updateTime, ch)
+}
+
+// Converts parsed OpenVPN server status information into Prometheus
+// metrics.
+func (e *OpenVPNExporter) collectServerStatus(ctx context.Context, source *statusSource, status *ServerStatus, ch chan<- prometheus.Metric) error {
+	if !status.UpdateTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			e.openvpnStatusUpdateTimeDesc,
+			prometheus.GaugeValue,
+			float64(status.UpdateTime.Unix()),
+			e.serverLabelValues(source)...)
+	}
+	if version := status.Version(); version != "" {
+		ch <- prometheus.MustNewConstMetric(
+			e.openvpnServerInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			append(e.serverLabelValues(source), version)...)
+	}
+	for key, value := range status.GlobalStats {
+		e.collectGlobalStat(source, key, value, ch)
+	}
+	// add the number of connected client
+	numberConnectedClient := e.collectServerEntries(ctx, source, status.entries, ch)
+	ch <- prometheus.MustNewConstMetric(
+		e.openvpnConnectedClientsDesc,
+		prometheus.GaugeValue,
+		float64(numberConnectedClient),
+		e.serverLabelValues(source)...)
+	if e.options.RequireEnd && !status.Complete {
+		return errTruncated
+	}
+	return e.collectStatusAge(source, status.UpdateTime, ch)
+}
 
-			// Store entry values in a map indexed by column name.
-			columnValues := map[string]string{}
-			for _, column := range header.LabelColumns {
-				columnValues[column] = ""
+// Records a malformed status line, which is skipped rather than failing
+// the whole scrape.
+func (e *OpenVPNExporter) skipMalformedLine(err error) {
+	e.logger.Warnf("Skipping malformed status line: %v", err)
+	e.statusParseErrors.Inc()
+}
+
+// Exports the time since the status was last updated and, with a
+// staleness threshold, whether it exceeds that, as happens when OpenVPN
+// stops rewriting its status file. Returns an error for stale statuses.
+func (e *OpenVPNExporter) collectStatusAge(source *statusSource, updateTime time.Time, ch chan<- prometheus.Metric) error {
+	if updateTime.IsZero() {
+		return nil
+	}
+	age := time.Since(updateTime)
+	ch <- prometheus.MustNewConstMetric(
+		e.openvpnStatusAgeDesc,
+		prometheus.GaugeValue,
+		age.Seconds(),
+		e.serverLabelValues(source)...)
+	if e.options.StaleAfter <= 0 {
+		return nil
+	}
+	staleValue := 0.0
+	if age > e.options.StaleAfter {
+		staleValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.openvpnStatusStaleDesc,
+		prometheus.GaugeValue,
+		staleValue,
+		e.serverLabelValues(source)...)
+	if staleValue == 1 {
+		return &collectError{reason: "stale", err: fmt.Errorf("status was last updated %s ago", age.Round(time.Second))}
+	}
+	return nil
+}
+
+// Exports a GLOBAL_STATS entry. Keys without a metric, such as those
+// added by newer OpenVPN versions, are skipped.
+func (e *OpenVPNExporter) collectGlobalStat(source *statusSource, key string, value string, ch chan<- prometheus.Metric) {
+	desc, ok := e.openvpnGlobalStatsDescs[key]
+	parsed, err := parseStatusValue(value)
+	if !ok {
+		// Statistics added by later OpenVPN releases are exported by
+		// key, as far as they are numeric.
+		if err != nil {
+			e.logger.Debugf("Skipping non-numeric GLOBAL_STATS key: %q", key)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.openvpnGlobalStatDesc,
+			prometheus.GaugeValue,
+			parsed,
+			append(e.serverLabelValues(source), key)...)
+		return
+	}
+	if err != nil {
+		e.skipMalformedLine(err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		desc,
+		prometheus.GaugeValue,
+		parsed,
+		e.serverLabelValues(source)...)
+}
+
+// Parses a numeric value of a status file. Large byte counts may be
+// written with thousands separators in the tab separated format.
+func parseStatusValue(value string) (float64, error) {
+	return strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64)
+}
+
+// Parses the human readable timestamps of the status files, which are
+// in the server's local time zone.
+func parseStatusTime(value string) (time.Time, error) {
+	return time.ParseInLocation("Mon Jan 2 15:04:05 2006", value, time.Local)
+}
+
+// Exports the metrics of a single CLIENT_LIST or ROUTING_TABLE entry,
+// given its values indexed by column name in the buffers. When export is
+// false, the entry's geo and rate columns are filled in without
+// exporting its metrics. Returns false if the entry was skipped.
+func (e *OpenVPNExporter) collectServerEntry(source *statusSource, header OpenvpnServerHeader, buffers *entryBuffers, export bool, ch chan<- prometheus.Metric) (bool, error) {
+	columnValues := buffers.columnValues
+	if columnValues["Common Name"] == "UNDEF" || columnValues["Common Name"] == "" {
+		if !e.options.IncludeUndef {
+			return false, nil // skip this 'client'
+		}
+		// Identify the client by its address instead.
+		columnValues["Common Name"] = columnValues["Real Address"]
+	}
+
+	if ip, ok := e.entryGeoAddress(columnValues); ok {
+		// Resolved beforehand by resolveGeo, if possible.
+		if geo, ok := e.geoCache.get(ip); ok {
+			columnValues["Geohash"] = e.geohash(geo)
+			if geo.City != "" {
+				columnValues["City"] = geo.City
+			} else {
+				columnValues["City"] = "Unknown"
 			}
-			for i, column := range columnNames {
-				columnValues[column] = fields[i+1]
+			if geo.RegionName != "" {
+				columnValues["Region"] = geo.RegionName
+			} else {
+				columnValues["Region"] = "Unknown"
 			}
-
-			if columnValues["Common Name"] == "UNDEF" || columnValues["Common Name"] == "" {
-				continue // skip this 'client'
+			if geo.CountryName != "" {
+				columnValues["Country"] = geo.CountryName
+			} else {
+				columnValues["Country"] = "Unknown"
+			}
+			// Coordinates that GeoIP didn't resolve, or that are out of
+			// range, yield neither a distance nor coordinate metrics.
+			serverGeo := e.sourceGeo(source)
+			if validCoordinates(geo.Lat, geo.Lon) {
+				if !e.options.DisableDistance && validCoordinates(serverGeo.Lat, serverGeo.Lon) {
+					d := distance(geo.Lat, geo.Lon, serverGeo.Lat, serverGeo.Lon) / distanceUnits[e.options.DistanceUnit]
+					columnValues["Distance From Server"] = fmt.Sprintf("%f", d)
+				}
+				columnValues["Latitude"] = fmt.Sprintf("%f", geo.Lat)
+				columnValues["Longitude"] = fmt.Sprintf("%f", geo.Lon)
 			}
+		}
+	}
+
+	if source.rates != nil {
+		e.collectClientRates(source, columnValues)
+	}
+	if source.bandwidth != nil {
+		e.collectClientBandwidth(source, columnValues)
+	}
+	if !export {
+		return true, nil
+	}
+
+	// Extract columns that should act as entry labels.
+	labels := append(buffers.labels[:0], e.serverLabelValues(source)...)
+	for _, column := range header.LabelColumns {
+		if e.hashedColumns[column] {
+			labels = append(labels, hashLabelValue(e.options.LabelHashSalt, columnValues[column]))
+		} else {
+			labels = append(labels, columnValues[column])
+		}
+	}
+	buffers.labels = labels
 
-			if fields[0] == "CLIENT_LIST" {
-				numberConnectedClient++
+	// Parse the relevant columns before exporting any of them, so that
+	// a malformed entry is skipped as a whole.
+	values, parsed := buffers.values[:0], buffers.parsed[:0]
+	for _, metric := range header.Metrics {
+		value, ok := 0.0, false
+		if len(metric.InfoColumns) > 0 {
+			value = 1
+			for _, column := range metric.InfoColumns {
+				ok = ok || columnValues[column] != ""
+			}
+		} else if columnValue, found := columnValues[metric.Column]; found {
+			var err error
+			value, err = parseStatusValue(columnValue)
+			if err != nil && !metric.Optional {
+				return false, err
 			}
+			ok = err == nil
+		}
+		values, parsed = append(values, value), append(parsed, ok)
+	}
+	buffers.values, buffers.parsed = values, parsed
 
-			if columnValues["Real Address"] != "" {
-				ip := strings.Split(columnValues["Real Address"], ":")[0]
-				geo, err := getGeo(ip)
-				if err != nil {
-					log.Printf("Error resolving GeoIP: %v", err)
-				} else {
-					columnValues["Geohash"] = geo.Geohash
-					if geo.City != "" {
-						columnValues["City"] = geo.City
-					} else {
-						columnValues["City"] = "Unknown"
-					}
-					if geo.RegionName != "" {
-						columnValues["Region"] = geo.RegionName
-					} else {
-						columnValues["Region"] = "Unknown"
-					}
-					if geo.CountryName != "" {
-						columnValues["Country"] = geo.CountryName
-					} else {
-						columnValues["Country"] = "Unknown"
-					}
-					if e.geoIP.Lon == 0 && e.geoIP.Lat == 0 {
-						// don't bother calculating, geoIP didn't resolve
-						columnValues["Distance From Server"] = "0"
-					} else {
-						d := distance(geo.Lat, geo.Lon, e.geoIP.Lat, e.geoIP.Lon)
-						columnValues["Distance From Server"] = fmt.Sprintf("%f", d)
+	// Export relevant columns as individual metrics, skipping entries
+	// whose full label set was already exported for the metric.
+	labelsKey := strings.Join(labels, "\x00")
+	for i, metric := range header.Metrics {
+		if !parsed[i] {
+			continue
+		}
+		metricLabels, metricKey := labels, labelsKey
+		if len(metric.InfoColumns) > 0 {
+		infoColumns:
+			for _, column := range metric.InfoColumns {
+				for _, labelColumn := range header.LabelColumns {
+					if column == labelColumn {
+						continue infoColumns
 					}
-
 				}
+				metricLabels = append(metricLabels, columnValues[column])
+			}
+			metricKey = strings.Join(metricLabels, "\x00")
+		}
+		recorded := buffers.recorded[metric.Desc]
+		if recorded == nil {
+			recorded = map[string]struct{}{}
+			buffers.recorded[metric.Desc] = recorded
+		}
+		if _, ok := recorded[metricKey]; ok {
+			e.logger.Debugf("Metric entry with same labels: %s, %s", metric.Desc, metricLabels)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			metric.Desc,
+			metric.ValueType,
+			values[i],
+			metricLabels...)
+		recorded[metricKey] = struct{}{}
+	}
+	return true, nil
+}
+
+// Adds the receive and send rates of a CLIENT_LIST entry to its column
+// values, once the client was seen in a previous scrape.
+func (e *OpenVPNExporter) collectClientRates(source *statusSource, columnValues map[string]string) {
+	receivedValue, receivedOk := columnValues["Bytes Received"]
+	sentValue, sentOk := columnValues["Bytes Sent"]
+	if !receivedOk || !sentOk {
+		return
+	}
+	received, err := parseStatusValue(receivedValue)
+	if err != nil {
+		return
+	}
+	sent, err := parseStatusValue(sentValue)
+	if err != nil {
+		return
+	}
+	key := columnValues["Common Name"] + "\x00" + columnValues["Real Address"]
+	if receiveRate, sendRate, ok := source.rates.update(key, received, sent, time.Now()); ok {
+		columnValues["Receive Rate"] = fmt.Sprintf("%f", receiveRate)
+		columnValues["Send Rate"] = fmt.Sprintf("%f", sendRate)
+	}
+}
+
+// Adds the traffic of a CLIENT_LIST entry since the previous scrape to
+// the lifetime totals of its common name.
+func (e *OpenVPNExporter) collectClientLifetime(source *statusSource, columnValues map[string]string) {
+	received, err := parseStatusValue(columnValues["Bytes Received"])
+	if err != nil {
+		return
+	}
+	sent, err := parseStatusValue(columnValues["Bytes Sent"])
+	if err != nil {
+		return
+	}
+	connectedSince, ok := columnValues["Connected Since (time_t)"]
+	if !ok {
+		connectedSince = columnValues["Connected Since"]
+	}
+	session := columnValues["Real Address"] + "\x00" + connectedSince
+	source.lifetimes.update(columnValues["Common Name"], session, received, sent)
+}
+
+// ParseRealAddress extracts the client IP from the Real Address column,
+// which holds an IPv4 or IPv6 address that is usually followed by a
+// port, as in 192.0.2.1:1194 or [2001:db8::1]:1194.
+func ParseRealAddress(address string) (net.IP, error) {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid real address: %q", address)
+	}
+	return ip, nil
+}
+
+// Returns the client address of a CLIENT_LIST or ROUTING_TABLE entry, if
+// its GeoIP data is to be resolved.
+func (e *OpenVPNExporter) entryGeoAddress(columnValues map[string]string) (string, bool) {
+	if !e.options.IncludeUndef && (columnValues["Common Name"] == "UNDEF" || columnValues["Common Name"] == "") {
+		return "", false
+	}
+	ip, err := ParseRealAddress(columnValues["Real Address"])
+	if err != nil || !e.wantsGeo(ip.String(), columnValues) {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// Buffers reused across the entries of a status, so that exporting an
+// entry allocates little beyond its metrics.
+type entryBuffers struct {
+	// Values of the current entry indexed by column name.
+	columnValues map[string]string
+	labels       []string
+	values       []float64
+	parsed       []bool
+	// Label sets already exported per metric.
+	recorded map[*prometheus.Desc]map[string]struct{}
+}
+
+func newEntryBuffers() *entryBuffers {
+	return &entryBuffers{
+		columnValues: map[string]string{},
+		recorded:     map[*prometheus.Desc]map[string]struct{}{},
+	}
+}
+
+// Indexes the values of an entry by column name in the buffers, replacing
+// those of the previous entry. Label columns missing from the entry are
+// set to empty values.
+func (b *entryBuffers) load(entry serverEntry, header OpenvpnServerHeader) {
+	for column := range b.columnValues {
+		delete(b.columnValues, column)
+	}
+	for _, column := range header.LabelColumns {
+		b.columnValues[column] = ""
+	}
+	for i, column := range entry.columnNames {
+		b.columnValues[column] = entry.fields[i]
+	}
+}
+
+// Logs the columns of the HEADER lines of entries that the exporter
+// doesn't know of, once per column, as they are ignored. Entries share
+// the column names of their HEADER, which are only checked once.
+func (e *OpenVPNExporter) logUnknownColumns(entries []serverEntry) {
+	var checked []string
+	for _, entry := range entries {
+		if len(entry.columnNames) == 0 || (len(checked) > 0 && &checked[0] == &entry.columnNames[0]) {
+			continue
+		}
+		checked = entry.columnNames
+		for _, column := range entry.columnNames {
+			if knownStatusColumns[entry.kind][column] {
+				continue
+			}
+			key := entry.kind + "\x00" + column
+			e.unknownColumnsMutex.Lock()
+			logged := e.unknownColumns[key]
+			if e.unknownColumns == nil {
+				e.unknownColumns = map[string]bool{}
 			}
+			e.unknownColumns[key] = true
+			e.unknownColumnsMutex.Unlock()
+			if !logged {
+				e.logger.Infof("Ignoring unknown %s column %q", entry.kind, column)
+			}
+		}
+	}
+}
+
+// Resolves the GeoIP data of the clients of the given entries, in a
+// single batch.
+func (e *OpenVPNExporter) resolveEntriesGeo(ctx context.Context, entries []serverEntry, buffers *entryBuffers) {
+	var addresses []string
+	for _, entry := range entries {
+		buffers.load(entry, e.openvpnServerHeaders[entry.kind])
+		if ip, ok := e.entryGeoAddress(buffers.columnValues); ok {
+			addresses = append(addresses, ip)
+		}
+	}
+	if len(addresses) > 0 {
+		e.resolveGeo(ctx, addresses)
+	}
+}
 
-			// Extract columns that should act as entry labels.
-			labels := []string{e.geoIP.Geohash,
-				e.geoIP.City,
-				e.geoIP.CountryName,
-				e.geoIP.RegionName,
-				e.geoIP.Ip}
-			for _, column := range header.LabelColumns {
-				labels = append(labels, columnValues[column])
+// ResolveClientGeo fills in the locations of the clients of a status
+// returned by ParseServerStatus, using the exporter's GeoIP provider and
+// cache. Clients whose location isn't resolved, as configured by the
+// exporter's options or due to lookup failures, are left without one.
+func (e *OpenVPNExporter) ResolveClientGeo(ctx context.Context, status *ServerStatus) {
+	buffers := newEntryBuffers()
+	e.resolveEntriesGeo(ctx, status.entries, buffers)
+	i := 0
+	for _, entry := range status.entries {
+		if entry.kind != "CLIENT_LIST" {
+			continue
+		}
+		buffers.load(entry, e.openvpnServerHeaders[entry.kind])
+		if ip, ok := e.entryGeoAddress(buffers.columnValues); ok {
+			if geo, ok := e.geoCache.get(ip); ok {
+				status.Clients[i].Geo = &geo
 			}
+		}
+		i++
+	}
+}
 
-			// Export relevant columns as individual metrics.
-			for _, metric := range header.Metrics {
-				if columnValue, ok := columnValues[metric.Column]; ok {
-					if l, _ := recordedMetrics[metric]; ! subslice(labels, l) {
-						value, err := strconv.ParseFloat(columnValue, 64)
-						if err != nil {
-							return err
-						}
-						ch <- prometheus.MustNewConstMetric(
-							metric.Desc,
-							metric.ValueType,
-							value,
-							labels...)
-						recordedMetrics[metric] = append(recordedMetrics[metric], labels...)
-					} else {
-						log.Printf("Metric entry with same labels: %s, %s", metric.Column, labels)
-					}
-				}
-				
+// Exports the entries of a server status after resolving their GeoIP
+// data, along with the number of clients per country and region, and
+// returns the number of exported clients.
+func (e *OpenVPNExporter) collectServerEntries(ctx context.Context, source *statusSource, entries []serverEntry, ch chan<- prometheus.Metric) int {
+	e.logUnknownColumns(entries)
+	buffers := newEntryBuffers()
+	e.resolveEntriesGeo(ctx, entries, buffers)
+
+	// Guard against the cardinality of servers with many clients by
+	// omitting all per-client series beyond the configured number.
+	truncated := false
+	if e.options.MaxClientSeries > 0 {
+		clients := 0
+		for _, entry := range entries {
+			commonName := entry.value("Common Name")
+			if entry.kind == "CLIENT_LIST" && (e.options.IncludeUndef || (commonName != "UNDEF" && commonName != "")) {
+				clients++
 			}
-		} else {
-			return fmt.Errorf("unsupported key: %q", fields[0])
+		}
+		if clients > e.options.MaxClientSeries {
+			truncated = true
+			e.logger.Warnf("Omitting per-client metrics: %d clients exceed the limit of %d", clients, e.options.MaxClientSeries)
 		}
 	}
-	// add the number of connected client
+	truncatedValue := 0.0
+	if truncated {
+		truncatedValue = 1
+	}
 	ch <- prometheus.MustNewConstMetric(
-		e.openvpnConnectedClientsDesc,
+		e.openvpnClientSeriesTruncatedDesc,
 		prometheus.GaugeValue,
-		float64(numberConnectedClient),
-		e.geoIP.Geohash,
-		e.geoIP.City,
-		e.geoIP.CountryName,
-		e.geoIP.RegionName,
-		e.geoIP.Ip)
-	return scanner.Err()
+		truncatedValue,
+		e.serverLabelValues(source)...)
+
+	numberConnectedClient := 0
+	type region struct{ country, region string }
+	clientsByCountry := map[string]int{}
+	clientsByRegion := map[region]int{}
+	type session struct{ commonName, realAddress string }
+	sessions := map[session]bool{}
+	connections := map[string]int{}
+	lastSeen := clientsLastSeen(entries)
+	for _, entry := range entries {
+		header := e.openvpnServerHeaders[entry.kind]
+		buffers.load(entry, header)
+		if entry.kind == "CLIENT_LIST" {
+			if seen, ok := lastSeen[clientSessionKey(entry)]; ok {
+				buffers.columnValues["Last Seen"] = seen
+			}
+		}
+		exported, err := e.collectServerEntry(source, header, buffers, !truncated, ch)
+		if err != nil {
+			e.skipMalformedLine(err)
+			continue
+		}
+		if exported && entry.kind == "CLIENT_LIST" {
+			numberConnectedClient++
+			country, ok := buffers.columnValues["Country"]
+			if !ok || country == "" {
+				country = "Unknown"
+			}
+			regionName, ok := buffers.columnValues["Region"]
+			if !ok || regionName == "" {
+				regionName = "Unknown"
+			}
+			clientsByCountry[country]++
+			clientsByRegion[region{country, regionName}]++
+			if source.lifetimes != nil {
+				e.collectClientLifetime(source, buffers.columnValues)
+			}
+			s := session{buffers.columnValues["Common Name"], buffers.columnValues["Real Address"]}
+			if !sessions[s] {
+				sessions[s] = true
+				connections[s.commonName]++
+			}
+		}
+	}
+
+	if e.openvpnClientConnectionsDesc != nil && !truncated {
+		for commonName, count := range connections {
+			if e.hashedColumns["Common Name"] {
+				commonName = hashLabelValue(e.options.LabelHashSalt, commonName)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				e.openvpnClientConnectionsDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				append(e.serverLabelValues(source), commonName)...)
+		}
+	}
+	if source.lifetimes != nil && !truncated {
+		source.lifetimes.each(func(commonName string, received float64, sent float64) {
+			if e.hashedColumns["Common Name"] {
+				commonName = hashLabelValue(e.options.LabelHashSalt, commonName)
+			}
+			labels := append(e.serverLabelValues(source), commonName)
+			ch <- prometheus.MustNewConstMetric(e.openvpnLifetimeReceivedDesc, prometheus.CounterValue, received, labels...)
+			ch <- prometheus.MustNewConstMetric(e.openvpnLifetimeSentDesc, prometheus.CounterValue, sent, labels...)
+		})
+	}
+	if !e.options.DisableGeoIP && !e.options.ServerGeoIPOnly {
+		for country, count := range clientsByCountry {
+			ch <- prometheus.MustNewConstMetric(
+				e.openvpnClientsByCountryDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				append(e.serverLabelValues(source), country)...)
+		}
+		for r, count := range clientsByRegion {
+			ch <- prometheus.MustNewConstMetric(
+				e.openvpnClientsByRegionDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				append(e.serverLabelValues(source), r.country, r.region)...)
+		}
+	}
+	return numberConnectedClient
 }
 
-// Does slice contain string
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+// Identifies the session of a CLIENT_LIST or ROUTING_TABLE entry.
+func clientSessionKey(entry serverEntry) string {
+	return entry.value("Common Name") + "\x00" + entry.value("Real Address")
+}
+
+// Returns the latest reference time of the routes of every session, as
+// listed in the routing table.
+func clientsLastSeen(entries []serverEntry) map[string]string {
+	lastSeen := map[string]string{}
+	latest := map[string]float64{}
+	for _, entry := range entries {
+		if entry.kind != "ROUTING_TABLE" {
+			continue
+		}
+		value := entry.value("Last Ref (time_t)")
+		lastRef, err := parseStatusValue(value)
+		if err != nil {
+			continue
 		}
+		key := clientSessionKey(entry)
+		if previous, ok := latest[key]; !ok || lastRef > previous {
+			latest[key], lastSeen[key] = lastRef, value
+		}
+	}
+	return lastSeen
+}
+
+// Whether a GeoIP lookup should be done for an entry. Entries below the
+// configured byte threshold only get geo data that is already cached,
+// which lets routing table entries of resolved clients share it.
+func (e *OpenVPNExporter) wantsGeo(ip string, columnValues map[string]string) bool {
+	if e.options.DisableGeoIP || e.options.ServerGeoIPOnly || e.excludedFromGeo(ip) {
+		return false
+	}
+	if e.options.GeoMinBytes == 0 {
+		return true
+	}
+	if _, ok := e.geoCache.get(ip); ok {
+		return true
+	}
+	received, _ := parseStatusValue(columnValues["Bytes Received"])
+	sent, _ := parseStatusValue(columnValues["Bytes Sent"])
+	return received+sent > float64(e.options.GeoMinBytes)
+}
+
+// Label values describing the server of a status source.
+func (e *OpenVPNExporter) serverLabelValues(source *statusSource) []string {
+	geo := e.sourceGeo(source)
+	values := []string{
+		source.Name,
+		e.geohash(geo),
+		geo.City,
+		geo.CountryName,
+		geo.RegionName,
+		geo.Ip,
+	}
+	for _, name := range e.options.ServerLabels {
+		values = append(values, source.Labels[name])
 	}
-	return false
+	return values
 }
 
-// Is a sub-slice of slice
-func subslice(sub []string, main []string) bool {
-	if len(sub) > len(main) {return false}
-	for _, s := range sub {
-		if ! contains(main, s) {
-			return false
+// Returns the location of the server of a status source, which is the
+// configured one if any, or else the one resolved by GeoIP.
+func (e *OpenVPNExporter) sourceGeo(source *statusSource) GeoIP {
+	if source.Location != nil {
+		return *source.Location
+	}
+	return e.serverGeo()
+}
+
+// Returns the status path with any management interface password
+// redacted, for use in labels.
+func redactStatusPath(statusPath string) string {
+	if u, err := url.Parse(statusPath); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return statusPath
+}
+
+// Source of statuses read from the status path -, which is replaced in
+// tests.
+var stdin io.Reader = os.Stdin
+
+func (e *OpenVPNExporter) collectStatusFromFile(ctx context.Context, source *statusSource, ch chan<- prometheus.Metric) error {
+	if u, err := url.Parse(source.Path); err == nil && (u.Scheme == "tcp" || u.Scheme == "unix") {
+		return e.collectStatusFromManagement(ctx, source, u, ch)
+	}
+	var file io.Reader = stdin
+	if u, err := url.Parse(source.Path); err == nil && u.Scheme == "ssh" {
+		status, err := readSSHStatus(ctx, u, e.options.SSHIdentityFile)
+		if err != nil {
+			return &collectError{reason: "open", err: err}
+		}
+		file = bytes.NewReader(status)
+	} else if err == nil && u.Scheme == "sacli" {
+		output, err := readAccessServerStatus(ctx, u)
+		if err != nil {
+			return &collectError{reason: "open", err: err}
+		}
+		status, err := accessServerStatus(output)
+		if err != nil {
+			return &collectError{reason: "parse", err: err}
 		}
+		file = bytes.NewReader(status)
+	} else if kind, api, ok := firewallURL(u); err == nil && ok {
+		output, err := readFirewallStatus(ctx, api)
+		if err != nil {
+			return &collectError{reason: "open", err: err}
+		}
+		status, err := firewallStatus(kind, output)
+		if err != nil {
+			return &collectError{reason: "parse", err: err}
+		}
+		file = bytes.NewReader(status)
+	} else if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		status, _, err := fetchRemoteStatus(ctx, source.Path, e.options.StatusBearerToken, remoteValidators{})
+		if err != nil {
+			return &collectError{reason: "open", err: err}
+		}
+		file = bytes.NewReader(status)
+	} else if info, err := os.Stat(source.Path); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		status, err := readFIFOStatus(ctx, source.Path)
+		if err != nil {
+			return &collectError{reason: "open", err: err}
+		}
+		file = bytes.NewReader(status)
+	} else if source.Path != "-" {
+		conn, err := os.Open(source.Path)
+		if err != nil {
+			return &collectError{reason: "open", err: err}
+		}
+		defer conn.Close()
+		file = conn
 	}
-	return true
+	return e.collectStatusFromStream(ctx, source, file, ch)
 }
 
-func (e *OpenVPNExporter) collectStatusFromFile(statusPath string, ch chan<- prometheus.Metric) error {
-	conn, err := os.Open(statusPath)
-	defer conn.Close()
-	if err != nil {
-		return err
+// Collects the metrics of a status read from a file, decompressing it
+// if needed.
+func (e *OpenVPNExporter) collectStatusFromStream(ctx context.Context, source *statusSource, file io.Reader, ch chan<- prometheus.Metric) error {
+	// Status files may have been compressed by external tooling.
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return &collectError{reason: "format", err: err}
+		}
+		defer gzipReader.Close()
+		return e.collectStatusFromReader(ctx, source, gzipReader, ch)
 	}
-	return e.collectStatusFromReader(statusPath, conn, ch)
+	return e.collectStatusFromReader(ctx, source, reader, ch)
 }
 
+// Describe sends the descriptors of every metric the exporter may
+// collect, so that registries can check them for consistency.
 func (e *OpenVPNExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.openvpnUpDesc
+	ch <- e.openvpnStatusUpdateTimeDesc
+	ch <- e.openvpnStatusAgeDesc
+	ch <- e.openvpnStatusStaleDesc
+	ch <- e.openvpnServerInfoDesc
+	ch <- e.openvpnConnectedClientsDesc
+	ch <- e.openvpnClientsByCountryDesc
+	ch <- e.openvpnClientsByRegionDesc
+	ch <- e.openvpnCollectSuccessDesc
+	ch <- e.openvpnCollectErrorDesc
+	ch <- e.openvpnScrapeDurationDesc
+	ch <- e.openvpnManagementAuthFailedDesc
+	ch <- e.openvpnClientSeriesTruncatedDesc
+	if e.openvpnClientConnectionsDesc != nil {
+		ch <- e.openvpnClientConnectionsDesc
+	}
+	if e.options.ClientLifetimeTotals {
+		ch <- e.openvpnLifetimeReceivedDesc
+		ch <- e.openvpnLifetimeSentDesc
+	}
+	for _, desc := range e.openvpnClientDescs {
+		ch <- desc
+	}
+	for _, desc := range e.openvpnGlobalStatsDescs {
+		ch <- desc
+	}
+	ch <- e.openvpnGlobalStatDesc
+	for _, header := range e.openvpnServerHeaders {
+		for _, metric := range header.Metrics {
+			ch <- metric.Desc
+		}
+	}
+	e.statusParseErrors.Describe(ch)
+	e.geoIPLookupFailures.Describe(ch)
+	e.geoIPLookupsDeferred.Describe(ch)
+	e.geoIPCacheHits.Describe(ch)
+	e.geoIPCacheMisses.Describe(ch)
+	e.geoIPCacheEvictions.Describe(ch)
+	e.geoIPResolutionDuration.Describe(ch)
 }
 
 func (e *OpenVPNExporter) Collect(ch chan<- prometheus.Metric) {
-	err := e.collectStatusFromFile(e.statusPath, ch)
+	e.collect(context.Background(), ch)
+}
+
+// Collects the metrics of every status source, up to SourceConcurrency
+// of them at once, giving up on them and on outstanding GeoIP lookups
+// once the context is done. Returns the error of the first source that
+// failed, in the order of the sources, if any.
+func (e *OpenVPNExporter) collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	sources := e.expandSources()
+	errs := make([]error, len(sources))
+	workers := e.options.SourceConcurrency
+	if workers > len(sources) {
+		workers = len(sources)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = e.collectSource(ctx, sources[i], ch)
+			}
+		}()
+	}
+	for i := range sources {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			firstErr = fmt.Errorf("%s: %v", sources[i].Name, err)
+			break
+		}
+	}
+	e.statusParseErrors.Collect(ch)
+	e.geoIPLookupFailures.Collect(ch)
+	e.geoIPLookupsDeferred.Collect(ch)
+	e.geoIPCacheHits.Collect(ch)
+	e.geoIPCacheMisses.Collect(ch)
+	e.geoIPCacheEvictions.Collect(ch)
+	e.geoIPResolutionDuration.Collect(ch)
+	return firstErr
+}
+
+// Collects the metrics of a status source, along with the outcome of
+// collecting it, so that a failing source doesn't affect the others.
+func (e *OpenVPNExporter) collectSource(ctx context.Context, source *statusSource, ch chan<- prometheus.Metric) error {
+	start := time.Now()
+	var cached bool
+	var err error
+	if timeout := e.sourceTimeout(source); timeout > 0 {
+		cached, err = e.collectStatusWithTimeout(ctx, source, timeout, ch)
+	} else {
+		cached, err = e.collectStatus(ctx, source, ch)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.openvpnScrapeDurationDesc,
+		prometheus.GaugeValue,
+		time.Since(start).Seconds(),
+		source.Name)
+	// Clients are only seen when the status is parsed.
+	if err == nil && !cached && source.rates != nil {
+		source.rates.prune()
+	}
+	if err == nil && !cached && source.lifetimes != nil {
+		source.lifetimes.prune()
+	}
 	if err == nil {
 		ch <- prometheus.MustNewConstMetric(
 			e.openvpnUpDesc,
 			prometheus.GaugeValue,
 			1.0,
-			e.geoIP.Geohash,
-			e.geoIP.City,
-			e.geoIP.CountryName,
-			e.geoIP.RegionName,
-			e.geoIP.Ip)
+			e.serverLabelValues(source)...)
+		ch <- prometheus.MustNewConstMetric(
+			e.openvpnCollectSuccessDesc,
+			prometheus.GaugeValue,
+			1.0,
+			source.Name)
 	} else {
-		log.Printf("Failed to scrape showq socket: %s", err)
+		e.logger.Errorf("Failed to collect OpenVPN status of %s: %s", source.Name, err)
 		ch <- prometheus.MustNewConstMetric(
 			e.openvpnUpDesc,
 			prometheus.GaugeValue,
 			0.0,
-			e.geoIP.Geohash,
-			e.geoIP.City,
-			e.geoIP.CountryName,
-			e.geoIP.RegionName,
-			e.geoIP.Ip)
+			e.serverLabelValues(source)...)
+		ch <- prometheus.MustNewConstMetric(
+			e.openvpnCollectSuccessDesc,
+			prometheus.GaugeValue,
+			0.0,
+			source.Name)
+		ch <- prometheus.MustNewConstMetric(
+			e.openvpnCollectErrorDesc,
+			prometheus.GaugeValue,
+			1.0,
+			source.Name,
+			collectErrorReason(err))
 	}
+	return err
 }
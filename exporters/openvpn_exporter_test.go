@@ -0,0 +1,1039 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/geohash"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestMain(m *testing.M) {
+	// Human readable timestamps are parsed in the local time zone.
+	time.Local = time.UTC
+	os.Exit(m.Run())
+}
+
+// GeoProvider placing the server in Utrecht and every client in
+// Amsterdam, without network access.
+type fakeGeoProvider struct{}
+
+func (fakeGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	geos := map[string]GeoIP{}
+	for _, address := range addresses {
+		if address == "" {
+			geos[address] = GeoIP{Ip: "192.0.2.1", CountryName: "Netherlands", RegionName: "Utrecht", City: "Utrecht", Lat: 52.09, Lon: 5.12, Geohash: geohash.Encode(52.09, 5.12)}
+		} else {
+			geos[address] = GeoIP{Ip: address, CountryName: "Netherlands", RegionName: "North Holland", City: "Amsterdam", Lat: 52.37, Lon: 4.89, Geohash: geohash.Encode(52.37, 4.89)}
+		}
+	}
+	return geos, nil
+}
+
+// Returns an exporter for a status file in testdata, with GeoIP data
+// provided by fakeGeoProvider.
+func newTestExporter(t testing.TB, name string, options Options) *OpenVPNExporter {
+	t.Helper()
+	if options.GeoProvider == nil {
+		options.GeoProvider = fakeGeoProvider{}
+	}
+	e, err := NewOpenVPNExporter(filepath.Join("testdata", name), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// Metrics about the exporter itself, which are left out of the golden
+// files. The testutil package of this client_golang version can't
+// compare unlabeled counters, so tests check them using ToFloat64, and
+// durations vary between runs.
+var exporterCounters = map[string]bool{
+	"openvpn_scrape_duration_seconds":           true,
+	"openvpn_status_age_seconds":                true,
+	"openvpn_geoip_resolution_duration_seconds": true,
+	"openvpn_status_parse_errors_total":         true,
+	"openvpn_geoip_lookup_failures_total":       true,
+	"openvpn_geoip_lookups_deferred_total":      true,
+	"openvpn_geoip_cache_hits_total":            true,
+	"openvpn_geoip_cache_misses_total":          true,
+	"openvpn_geoip_cache_evictions_total":       true,
+}
+
+// Compares the metrics of a collector to a golden file in testdata, or
+// rewrites the golden file when the -update flag is given.
+func compareGolden(t *testing.T, c prometheus.Collector, golden string) {
+	t.Helper()
+	path := filepath.Join("testdata", golden)
+	if *update {
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(c)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for _, family := range families {
+			if exporterCounters[family.GetName()] {
+				continue
+			}
+			if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	if err := testutil.CollectAndCompare(c, bytes.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectStatusFormats(t *testing.T) {
+	for _, test := range []struct {
+		status string
+		golden string
+	}{
+		{"server1.status", "server1.metrics"},
+		{"server2.status", "server2.metrics"},
+		{"server3.status", "server3.metrics"},
+		{"server2_openvpn26.status", "server2_openvpn26.metrics"},
+		{"server2_dual_stack.status", "server2_dual_stack.metrics"},
+		{"client.status", "client.metrics"},
+	} {
+		t.Run(test.status, func(t *testing.T) {
+			e := newTestExporter(t, test.status, Options{RequireEnd: true})
+			compareGolden(t, e, test.golden)
+		})
+	}
+}
+
+func TestRequireEnd(t *testing.T) {
+	// The status was cut off in the middle of its routing table.
+	e := newTestExporter(t, "server2_truncated.status", Options{RequireEnd: true})
+	expected := `# HELP openvpn_up Whether scraping OpenVPN's metrics was successful.
+# TYPE openvpn_up gauge
+openvpn_up{server_city="Utrecht",server_country="Netherlands",server_geohash="u178k",server_name="testdata/server2_truncated.status",server_public_ip="192.0.2.1",server_region="Utrecht"} 0
+# HELP openvpn_collect_error Set when collecting the status source failed, labeled with the reason.
+# TYPE openvpn_collect_error gauge
+openvpn_collect_error{reason="truncated",server_name="testdata/server2_truncated.status"} 1
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_up", "openvpn_collect_error"); err != nil {
+		t.Error(err)
+	}
+
+	// Without RequireEnd, the clients read before the cut are exported.
+	e = newTestExporter(t, "server2_truncated.status", Options{})
+	expected = `# HELP openvpn_up Whether scraping OpenVPN's metrics was successful.
+# TYPE openvpn_up gauge
+openvpn_up{server_city="Utrecht",server_country="Netherlands",server_geohash="u178k",server_name="testdata/server2_truncated.status",server_public_ip="192.0.2.1",server_region="Utrecht"} 1
+# HELP openvpn_server_connected_clients Number Of Connected Clients
+# TYPE openvpn_server_connected_clients gauge
+openvpn_server_connected_clients{server_city="Utrecht",server_country="Netherlands",server_geohash="u178k",server_name="testdata/server2_truncated.status",server_public_ip="192.0.2.1",server_region="Utrecht"} 6
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_up", "openvpn_server_connected_clients", "openvpn_collect_error"); err != nil {
+		t.Error(err)
+	}
+}
+
+// Registering with a pedantic registry fails if Describe misses any of
+// the descriptors of the collected metrics, with every optional metric
+// enabled.
+func TestDescribeCoversCollectedMetrics(t *testing.T) {
+	for _, status := range []string{"server1.status", "server2.status", "server3.status", "server2_openvpn26.status", "server2_tls_version.status", "client.status"} {
+		t.Run(status, func(t *testing.T) {
+			e := newTestExporter(t, status, Options{
+				ClientCoordinates:    true,
+				ClientRates:          true,
+				ClientLifetimeTotals: true,
+			})
+			registry := prometheus.NewPedanticRegistry()
+			if err := registry.Register(e); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := registry.Gather(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectUndefClients(t *testing.T) {
+	e := newTestExporter(t, "server2_undef.status", Options{})
+	compareGolden(t, e, "server2_undef.metrics")
+	e = newTestExporter(t, "server2_undef.status", Options{IncludeUndef: true})
+	compareGolden(t, e, "server2_undef_included.metrics")
+}
+
+func TestCollectStaleStatus(t *testing.T) {
+	// The example status was last updated in 2017.
+	e := newTestExporter(t, "server2.status", Options{StaleAfter: time.Hour})
+	compareGolden(t, e, "server2_stale.metrics")
+}
+
+func TestStatusAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.status")
+	updated := time.Now().Add(-90 * time.Second).Unix()
+	status := "TITLE,OpenVPN 2.4.7 x86_64-pc-linux-gnu\n" +
+		fmt.Sprintf("TIME,%s,%d\n", time.Unix(updated, 0).Format(time.ANSIC), updated) +
+		"END\n"
+	if err := ioutil.WriteFile(path, []byte(status), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewOpenVPNExporter(path, Options{DisableGeoIP: true, StaleAfter: time.Hour, CacheUnchangedStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cached metrics are replayed with the current age.
+	for i := 0; i < 2; i++ {
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(e)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+		if age := values["openvpn_status_age_seconds"]; age < 90 || age > 120 {
+			t.Errorf("scrape %d: expected a status age of about 90 seconds, got %v", i, age)
+		}
+		if stale, ok := values["openvpn_status_stale"]; !ok || stale != 0 {
+			t.Errorf("scrape %d: expected a fresh status, got %v", i, stale)
+		}
+	}
+}
+
+func TestStatusFormat(t *testing.T) {
+	// The status lacks its TITLE line, so its format can't be detected.
+	e := newTestExporter(t, "server2_untitled.status", Options{})
+	if reason := gatherLabel(t, e, "openvpn_collect_error", "reason"); reason != "format" {
+		t.Errorf("expected a format error, got %q", reason)
+	}
+	e = newTestExporter(t, "server2_untitled.status", Options{StatusFormat: StatusFormatV2})
+	compareGolden(t, e, "server2_untitled.metrics")
+
+	if _, err := NewOpenVPNExporter(filepath.Join("testdata", "server2.status"), Options{StatusFormat: "v4"}); err == nil {
+		t.Error("expected an error for an unknown status format")
+	}
+}
+
+func TestCollectWithoutGeoIP(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+	compareGolden(t, e, "server2_no_geoip.metrics")
+}
+
+func TestServerGeoIPOnly(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{ServerGeoIPOnly: true})
+	compareGolden(t, e, "server2_server_geoip_only.metrics")
+	if misses := testutil.ToFloat64(e.geoIPCacheMisses); misses != 0 {
+		t.Errorf("expected no client lookups, got %v cache misses", misses)
+	}
+}
+
+func TestGeoIPCache(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{})
+	for i := 0; i < 2; i++ {
+		compareGolden(t, e, "server2.metrics")
+	}
+	// All clients of the example share the same address.
+	if misses := testutil.ToFloat64(e.geoIPCacheMisses); misses != 1 {
+		t.Errorf("expected 1 cache miss, got %v", misses)
+	}
+	if hits := testutil.ToFloat64(e.geoIPCacheHits); hits != 1 {
+		t.Errorf("expected 1 cache hit, got %v", hits)
+	}
+	if failures := testutil.ToFloat64(e.geoIPLookupFailures); failures != 0 {
+		t.Errorf("expected no lookup failures, got %v", failures)
+	}
+}
+
+func TestParseRealAddress(t *testing.T) {
+	for _, test := range []struct {
+		address  string
+		expected string
+	}{
+		{"198.51.100.7:1194", "198.51.100.7"},
+		{"[2001:db8::1]:1194", "2001:db8::1"},
+		{"198.51.100.7", "198.51.100.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"not-an-address:1194", ""},
+		{"", ""},
+	} {
+		ip, err := ParseRealAddress(test.address)
+		switch {
+		case test.expected == "" && err == nil:
+			t.Errorf("%q: expected an error, got %v", test.address, ip)
+		case test.expected != "" && err != nil:
+			t.Errorf("%q: %v", test.address, err)
+		case test.expected != "" && ip.String() != test.expected:
+			t.Errorf("%q: expected %s, got %s", test.address, test.expected, ip)
+		}
+	}
+}
+
+// GeoProvider recording the client addresses it is asked to resolve.
+type recordingGeoProvider struct {
+	mutex     sync.Mutex
+	addresses []string
+}
+
+func (p *recordingGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	p.mutex.Lock()
+	for _, address := range addresses {
+		if address != "" {
+			p.addresses = append(p.addresses, address)
+		}
+	}
+	p.mutex.Unlock()
+	return fakeGeoProvider{}.Lookup(ctx, addresses)
+}
+
+func TestGeoMinBytes(t *testing.T) {
+	status := filepath.Join(t.TempDir(), "server.status")
+	contents := `TITLE,OpenVPN 2.4.4 x86_64-pc-linux-gnu
+TIME,Tue Mar 21 10:39:14 2017,1490089154
+HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username
+CLIENT_LIST,idle,198.51.100.1:1194,10.8.0.2,100,200,Thu Mar 16 17:09:03 2017,1489680543,UNDEF
+CLIENT_LIST,threshold,198.51.100.2:1194,10.8.0.3,400,600,Thu Mar 16 17:09:03 2017,1489680543,UNDEF
+CLIENT_LIST,busy,198.51.100.3:1194,10.8.0.4,1500,500,Thu Mar 16 17:09:03 2017,1489680543,UNDEF
+HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)
+ROUTING_TABLE,10.8.0.2,idle,198.51.100.1:1194,Tue Mar 21 10:26:48 2017,1490088408
+ROUTING_TABLE,10.8.0.4,busy,198.51.100.3:1194,Tue Mar 21 10:26:48 2017,1490088408
+END
+`
+	if err := os.WriteFile(status, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	provider := &recordingGeoProvider{}
+	e, err := NewOpenVPNExporter(status, Options{GeoProvider: provider, GeoMinBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(e)
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the client that transferred more than 1000 bytes is resolved.
+	if expected := []string{"198.51.100.3"}; !reflect.DeepEqual(provider.addresses, expected) {
+		t.Errorf("expected lookups of %v, got %v", expected, provider.addresses)
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{ServerAddress: "198.51.100.7"})
+	if geo := e.serverGeo(); geo.Ip != "198.51.100.7" || geo.City != "Amsterdam" {
+		t.Errorf("expected the server to be located at its configured address, got %+v", geo)
+	}
+}
+
+func TestServerAddressPerExporter(t *testing.T) {
+	// The clients are in Amsterdam, like a server at the configured
+	// address, while the server the exporter runs on is in Utrecht.
+	for _, test := range []struct {
+		serverAddress string
+		distance      float64
+	}{
+		{"198.51.100.7", 0},
+		{"", 34891.857062},
+	} {
+		e := newTestExporter(t, "server2_openvpn26.status", Options{ServerAddress: test.serverAddress})
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(e)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, family := range families {
+			if family.GetName() != "openvpn_server_client_distance" {
+				continue
+			}
+			found = true
+			if d := family.GetMetric()[0].GetGauge().GetValue(); math.Abs(d-test.distance) > 1 {
+				t.Errorf("server address %q: expected a client distance of %v, got %v", test.serverAddress, test.distance, d)
+			}
+		}
+		if !found {
+			t.Errorf("server address %q: expected a client distance", test.serverAddress)
+		}
+	}
+}
+
+func TestCollectSkipsMalformedGlobalStats(t *testing.T) {
+	e := newTestExporter(t, "server2_openvpn26.status", Options{})
+	compareGolden(t, e, "server2_openvpn26.metrics")
+	// Only the GLOBAL_STATS line lacking a key and value is malformed.
+	if errors := testutil.ToFloat64(e.statusParseErrors); errors != 1 {
+		t.Errorf("expected 1 parse error, got %v", errors)
+	}
+}
+
+// Returns a version 2 server status listing the given number of
+// clients, each with a routing table entry.
+func generateServerStatus(clients int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("TITLE,OpenVPN 2.5.1 x86_64-pc-linux-gnu\n")
+	buf.WriteString("TIME,Tue Mar 21 10:39:14 2017,1490089154\n")
+	buf.WriteString("HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID,Data Channel Cipher\n")
+	for i := 0; i < clients; i++ {
+		fmt.Fprintf(&buf, "CLIENT_LIST,client%d,198.51.%d.%d:1194,10.8.%d.%d,,%d,%d,Thu Mar 16 17:09:03 2017,1489680543,UNDEF,%d,%d,AES-256-GCM\n",
+			i, i/256%256, i%256, i/256%256, i%256, i*1000, i*2000, i, i)
+	}
+	buf.WriteString("HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)\n")
+	for i := 0; i < clients; i++ {
+		fmt.Fprintf(&buf, "ROUTING_TABLE,10.8.%d.%d,client%d,198.51.%d.%d:1194,Tue Mar 21 10:26:48 2017,1490088408\n",
+			i/256%256, i%256, i, i/256%256, i%256)
+	}
+	buf.WriteString("GLOBAL_STATS,Max bcast/mcast queue length,0\nEND\n")
+	return buf.Bytes()
+}
+
+func BenchmarkCollectServerStatus(b *testing.B) {
+	status := generateServerStatus(10000)
+	e := newTestExporter(b, "server2.status", Options{DisableGeoIP: true})
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+	defer close(ch)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.collectStatusFromReader(context.Background(), e.sources[0], bytes.NewReader(status), ch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestScrapeDurations(t *testing.T) {
+	for _, test := range []struct {
+		options     Options
+		resolutions uint64
+	}{
+		{Options{}, 1},
+		{Options{DisableGeoIP: true}, 0},
+	} {
+		e := newTestExporter(t, "server2.status", test.options)
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(e)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]*dto.MetricFamily{}
+		for _, family := range families {
+			found[family.GetName()] = family
+		}
+		if found["openvpn_scrape_duration_seconds"] == nil {
+			t.Error("expected the scrape duration to be exported")
+		}
+		family := found["openvpn_geoip_resolution_duration_seconds"]
+		if family == nil {
+			t.Fatal("expected the GeoIP resolution duration to be exported")
+		}
+		if count := family.GetMetric()[0].GetHistogram().GetSampleCount(); count != test.resolutions {
+			t.Errorf("expected %d GeoIP resolutions, got %d", test.resolutions, count)
+		}
+	}
+}
+
+func TestMetricNamespace(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{Namespace: "ovpn", Subsystem: "legacy"})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "ovpn_legacy_") {
+			t.Errorf("expected %s to be prefixed with ovpn_legacy_", family.GetName())
+		}
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{"ovpn_legacy_up", "ovpn_legacy_server_client_received_bytes_total", "ovpn_legacy_status_parse_errors_total"} {
+		if !names[name] {
+			t.Errorf("expected %s to be exported", name)
+		}
+	}
+
+	if _, err := NewOpenVPNExporter(filepath.Join("testdata", "server2.status"), Options{Namespace: "open-vpn", DisableGeoIP: true}); err == nil {
+		t.Error("expected an error for an invalid namespace")
+	}
+}
+
+func TestCollectSharedCommonName(t *testing.T) {
+	// Both sessions of the laptop are exported, and counted as
+	// connections of its common name.
+	e := newTestExporter(t, "server2_shared_cn.status", Options{})
+	compareGolden(t, e, "server2_shared_cn.metrics")
+}
+
+func TestCollectWindowsStatus(t *testing.T) {
+	// Status files with a byte order mark and CRLF line endings give the
+	// same metrics as their Unix counterparts.
+	for _, name := range []string{"server2", "server3"} {
+		t.Run(name, func(t *testing.T) {
+			e := newTestExporter(t, name+"_windows.status", Options{RequireEnd: true, ServerName: "testdata/" + name + ".status"})
+			compareGolden(t, e, name+".metrics")
+		})
+	}
+}
+
+func TestCollectMaxClientSeries(t *testing.T) {
+	// Within the limit, every client is exported.
+	e := newTestExporter(t, "server2_shared_cn.status", Options{MaxClientSeries: 3})
+	compareGolden(t, e, "server2_shared_cn.metrics")
+	// Beyond it, only totals and per-country and per-region counts are.
+	e = newTestExporter(t, "server2_shared_cn.status", Options{MaxClientSeries: 2})
+	compareGolden(t, e, "server2_shared_cn_truncated.metrics")
+}
+
+// GeoProvider that holds back client lookups until released.
+type gatedGeoProvider struct {
+	release chan struct{}
+}
+
+func (p gatedGeoProvider) Lookup(ctx context.Context, addresses []string) (map[string]GeoIP, error) {
+	if len(addresses) != 1 || addresses[0] != "" {
+		<-p.release
+	}
+	return fakeGeoProvider{}.Lookup(ctx, addresses)
+}
+
+// Returns the number of metrics of a family.
+func gatherCount(t *testing.T, c prometheus.Collector, name string) int {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return len(family.GetMetric())
+		}
+	}
+	return 0
+}
+
+// Returns the value of a label of the first metric of a family.
+func gatherLabel(t *testing.T, c prometheus.Collector, name string, label string) string {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, pair := range family.GetMetric()[0].GetLabel() {
+			if pair.GetName() == label {
+				return pair.GetValue()
+			}
+		}
+	}
+	t.Fatalf("no %s label on %s", label, name)
+	return ""
+}
+
+func TestGeoCachePerExporter(t *testing.T) {
+	e := newTestExporter(t, "server2_openvpn26.status", Options{})
+	other := newTestExporter(t, "server2_openvpn26.status", Options{})
+
+	// Concurrent scrapes share the exporter's cache safely.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan prometheus.Metric)
+			go func() {
+				e.Collect(ch)
+				close(ch)
+			}()
+			for range ch {
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := e.geoCache.get("198.51.100.23"); !ok {
+		t.Error("expected the client to be cached")
+	}
+	if _, ok := other.geoCache.get("198.51.100.23"); ok {
+		t.Error("expected exporters not to share their cache")
+	}
+}
+
+func TestAsyncGeoIP(t *testing.T) {
+	provider := gatedGeoProvider{release: make(chan struct{})}
+	e := newTestExporter(t, "server2_openvpn26.status", Options{AsyncGeoIP: true, GeoProvider: provider})
+
+	// The first scrape doesn't wait for the client to be resolved.
+	if country := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "country"); country != "" {
+		t.Errorf("expected no country before resolution, got %q", country)
+	}
+	close(provider.release)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := e.geoCache.get("198.51.100.23"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client was not resolved in the background")
+		}
+	}
+	if country := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "country"); country != "Netherlands" {
+		t.Errorf("expected the resolved country, got %q", country)
+	}
+}
+
+func TestCollectQuotedCommonNames(t *testing.T) {
+	e := newTestExporter(t, "server2_quoted.status", Options{RequireEnd: true})
+	compareGolden(t, e, "server2_quoted.metrics")
+	if errors := testutil.ToFloat64(e.statusParseErrors); errors != 0 {
+		t.Errorf("expected no parse errors, got %v", errors)
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	e := newTestExporter(t, "server2_tls_version.status", Options{})
+	if cipher := gatherLabel(t, e, "openvpn_server_client_info", "cipher"); cipher != "AES-256-GCM" {
+		t.Errorf("expected the cipher label to be AES-256-GCM, got %q", cipher)
+	}
+	if version := gatherLabel(t, e, "openvpn_server_client_info", "tls_version"); version != "TLSv1.3" {
+		t.Errorf("expected the tls_version label to be TLSv1.3, got %q", version)
+	}
+}
+
+// Writes a version 2 status listing a single session of a common name.
+func writeClientStatus(t *testing.T, path string, connectedSince int, received int, sent int) {
+	t.Helper()
+	status := "TITLE,OpenVPN 2.4.7 x86_64-pc-linux-gnu\n" +
+		"TIME,Tue Mar 21 10:39:14 2017,1490089154\n" +
+		"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username\n" +
+		fmt.Sprintf("CLIENT_LIST,laptop,198.51.100.10:19021,10.8.0.2,%d,%d,Thu Mar 16 17:09:03 2017,%d,UNDEF\n", received, sent, connectedSince) +
+		"END\n"
+	if err := ioutil.WriteFile(path, []byte(status), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientLifetimeTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.status")
+	e, err := NewOpenVPNExporter(path, Options{DisableGeoIP: true, ClientLifetimeTotals: true, ServerName: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := func(received int, sent int) string {
+		return fmt.Sprintf(`# HELP openvpn_server_client_lifetime_received_bytes_total Amount of data received from a common name over all of its sessions since the exporter started, in bytes.
+# TYPE openvpn_server_client_lifetime_received_bytes_total counter
+openvpn_server_client_lifetime_received_bytes_total{common_name="laptop",server_city="",server_country="",server_geohash="",server_name="server",server_public_ip="",server_region=""} %d
+# HELP openvpn_server_client_lifetime_sent_bytes_total Amount of data sent to a common name over all of its sessions since the exporter started, in bytes.
+# TYPE openvpn_server_client_lifetime_sent_bytes_total counter
+openvpn_server_client_lifetime_sent_bytes_total{common_name="laptop",server_city="",server_country="",server_geohash="",server_name="server",server_public_ip="",server_region=""} %d
+`, received, sent)
+	}
+	names := []string{"openvpn_server_client_lifetime_received_bytes_total", "openvpn_server_client_lifetime_sent_bytes_total"}
+
+	for _, step := range []struct {
+		connectedSince, received, sent int
+		totalReceived, totalSent       int
+	}{
+		{1489680543, 100, 10, 100, 10},
+		{1489680543, 150, 20, 150, 20},
+		// The client reconnected, starting a new session.
+		{1489690000, 30, 5, 180, 25},
+		// The counters went down within the same session, as after a
+		// server restart reusing the connection time.
+		{1489690000, 10, 1, 190, 26},
+	} {
+		writeClientStatus(t, path, step.connectedSince, step.received, step.sent)
+		if err := testutil.CollectAndCompare(e, strings.NewReader(expected(step.totalReceived, step.totalSent)), names...); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientLifetimeTotalsRequireCommonName(t *testing.T) {
+	_, err := NewOpenVPNExporter(filepath.Join("testdata", "server2.status"), Options{
+		ClientLifetimeTotals: true,
+		LabelModes:           map[string]LabelMode{"common_name": LabelDrop},
+	})
+	if err == nil {
+		t.Error("expected an error when common names are dropped")
+	}
+}
+
+func TestCollectClientLabels(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{ClientLabels: []string{"common_name", "country"}})
+	compareGolden(t, e, "server2_client_labels.metrics")
+}
+
+// Records the messages logged at the info level.
+type recordingLogger struct {
+	nopLogger
+	mutex sync.Mutex
+	infos []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func TestCollectUnknownColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.status")
+	status := "TITLE,OpenVPN 2.7.0 x86_64-pc-linux-gnu\n" +
+		"TIME,2023-05-11 16:20:37,1683822037\n" +
+		"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Future Column,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username\n" +
+		"CLIENT_LIST,alice,198.51.100.23:50112,10.8.0.6,something,1851263,2741904,2023-05-11 15:02:44,1683817364,UNDEF\n" +
+		"END\n"
+	if err := ioutil.WriteFile(path, []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordingLogger{}
+	e, err := NewOpenVPNExporter(path, Options{DisableGeoIP: true, ServerName: "server", Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP openvpn_server_client_received_bytes_total Amount of data received over a connection on the VPN server, in bytes.
+# TYPE openvpn_server_client_received_bytes_total counter
+openvpn_server_client_received_bytes_total{city="",client_id="",common_name="alice",connection_time="1683817364",country="",geohash="",peer_id="",real_address="198.51.100.23:50112",region="",server_city="",server_country="",server_geohash="",server_name="server",server_public_ip="",server_region="",username="UNDEF",virtual_address="10.8.0.6",virtual_ipv6_address=""} 1.851263e+06
+`
+	for i := 0; i < 2; i++ {
+		if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_server_client_received_bytes_total"); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(logger.infos) != 1 || !strings.Contains(logger.infos[0], `"Future Column"`) {
+		t.Errorf("expected the unknown column to be logged once, got %q", logger.infos)
+	}
+}
+
+func TestCollectDataChannelCipherLabel(t *testing.T) {
+	e := newTestExporter(t, "server2_dual_stack.status", Options{ClientLabels: []string{"common_name", "data_channel_cipher"}})
+	compareGolden(t, e, "server2_dual_stack_cipher_label.metrics")
+}
+
+func TestClientLabelsRejectsUnknownLabels(t *testing.T) {
+	for _, label := range []string{"server_country", "nonexistent"} {
+		_, err := NewOpenVPNExporter(filepath.Join("testdata", "server2.status"), Options{ClientLabels: []string{label}})
+		if err == nil {
+			t.Errorf("expected an error selecting %s", label)
+		}
+	}
+}
+
+func TestCacheUnchangedStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.status")
+	e, err := NewOpenVPNExporter(path, Options{DisableGeoIP: true, CacheUnchangedStatus: true, ServerName: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2017, 3, 21, 10, 39, 14, 0, time.UTC)
+	expected := func(received int) string {
+		return fmt.Sprintf(`# HELP openvpn_server_client_received_bytes_total Amount of data received over a connection on the VPN server, in bytes.
+# TYPE openvpn_server_client_received_bytes_total counter
+openvpn_server_client_received_bytes_total{city="",client_id="",common_name="laptop",connection_time="1489680543",country="",geohash="",peer_id="",real_address="198.51.100.10:19021",region="",server_city="",server_country="",server_geohash="",server_name="server",server_public_ip="",server_region="",username="UNDEF",virtual_address="10.8.0.2",virtual_ipv6_address=""} %d
+`, received)
+	}
+
+	writeClientStatus(t, path, 1489680543, 100, 10)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected(100)), "openvpn_server_client_received_bytes_total"); err != nil {
+		t.Error(err)
+	}
+
+	// A rewrite keeping the modification time and size isn't noticed.
+	writeClientStatus(t, path, 1489680543, 200, 20)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected(100)), "openvpn_server_client_received_bytes_total"); err != nil {
+		t.Error(err)
+	}
+
+	modTime = modTime.Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected(200)), "openvpn_server_client_received_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGeohashPrecision(t *testing.T) {
+	e := newTestExporter(t, "server2.status", Options{})
+	if hash := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "geohash"); hash != "u173z" {
+		t.Errorf("expected a geohash of 5 characters by default, got %q", hash)
+	}
+	e = newTestExporter(t, "server2.status", Options{GeohashPrecision: 12})
+	if hash := gatherLabel(t, e, "openvpn_server_client_received_bytes_total", "server_geohash"); hash != "u178kd8q0xu9" {
+		t.Errorf("expected a full precision server geohash, got %q", hash)
+	}
+	if _, err := NewOpenVPNExporter(filepath.Join("testdata", "server2.status"), Options{GeohashPrecision: 13, DisableGeoIP: true}); err == nil {
+		t.Error("expected an error for a geohash precision above 12")
+	}
+}
+
+func TestMultipleStatusSources(t *testing.T) {
+	e, err := NewMultiOpenVPNExporter([]StatusSource{
+		{Name: "udp", Path: filepath.Join("testdata", "server2.status")},
+		{Name: "tcp", Path: filepath.Join("testdata", "server3.status")},
+		{Name: "down", Path: filepath.Join("testdata", "missing.status")},
+	}, Options{DisableGeoIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP openvpn_up Whether scraping OpenVPN's metrics was successful.
+# TYPE openvpn_up gauge
+openvpn_up{server_city="",server_country="",server_geohash="",server_name="down",server_public_ip="",server_region=""} 0
+openvpn_up{server_city="",server_country="",server_geohash="",server_name="tcp",server_public_ip="",server_region=""} 1
+openvpn_up{server_city="",server_country="",server_geohash="",server_name="udp",server_public_ip="",server_region=""} 1
+# HELP openvpn_server_connected_clients Number Of Connected Clients
+# TYPE openvpn_server_connected_clients gauge
+openvpn_server_connected_clients{server_city="",server_country="",server_geohash="",server_name="tcp",server_public_ip="",server_region=""} 5
+openvpn_server_connected_clients{server_city="",server_country="",server_geohash="",server_name="udp",server_public_ip="",server_region=""} 6
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_up", "openvpn_server_connected_clients"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMalformedStatusSource(t *testing.T) {
+	// A malformed source, here an error page served instead of the
+	// status, only reports being down, while a healthy one reports its
+	// clients as usual.
+	e, err := NewMultiOpenVPNExporter([]StatusSource{
+		{Name: "healthy", Path: filepath.Join("testdata", "server2.status")},
+		{Name: "malformed", Path: filepath.Join("testdata", "malformed.status")},
+	}, Options{DisableGeoIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, e, "malformed_source.metrics")
+}
+
+func TestSetStatusSources(t *testing.T) {
+	udp := StatusSource{Name: "udp", Path: filepath.Join("testdata", "server2.status")}
+	e, err := NewMultiOpenVPNExporter([]StatusSource{udp}, Options{DisableGeoIP: true, ClientRates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates := e.statusSources()[0].rates
+
+	tcp := StatusSource{Name: "tcp", Path: filepath.Join("testdata", "server3.status")}
+	if err := e.SetStatusSources([]StatusSource{udp, tcp}); err != nil {
+		t.Fatal(err)
+	}
+	sources := e.statusSources()
+	if len(sources) != 2 || sources[0].rates != rates {
+		t.Error("expected the unchanged source to keep its state")
+	}
+	if count := gatherCount(t, e, "openvpn_up"); count != 2 {
+		t.Errorf("expected both sources to be collected, got %d", count)
+	}
+
+	// Invalid sources leave the current ones in place.
+	for _, invalid := range [][]StatusSource{nil, {udp, udp}, {{Path: "/run/openvpn/[.status"}}} {
+		if err := e.SetStatusSources(invalid); err == nil {
+			t.Errorf("expected an error setting %v", invalid)
+		}
+	}
+	if count := len(e.statusSources()); count != 2 {
+		t.Errorf("expected the sources to be kept, got %d", count)
+	}
+}
+
+func TestConcurrentStatusSources(t *testing.T) {
+	status, err := ioutil.ReadFile(filepath.Join("testdata", "server3.status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		w.Write(status)
+	}))
+	defer server.Close()
+
+	sources := []StatusSource{{Name: "missing", Path: filepath.Join("testdata", "nonexistent.status")}}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		sources = append(sources, StatusSource{Name: name, Path: server.URL + "/" + name})
+	}
+	e, err := NewMultiOpenVPNExporter(sources, Options{DisableGeoIP: true, SourceConcurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP openvpn_collect_success Whether collecting the status source was successful.
+# TYPE openvpn_collect_success gauge
+openvpn_collect_success{server_name="a"} 1
+openvpn_collect_success{server_name="b"} 1
+openvpn_collect_success{server_name="c"} 1
+openvpn_collect_success{server_name="d"} 1
+openvpn_collect_success{server_name="e"} 1
+openvpn_collect_success{server_name="missing"} 0
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_collect_success"); err != nil {
+		t.Error(err)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("expected 2 sources to be collected at once, got %d", maxInFlight)
+	}
+}
+
+func TestStatusSourceTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	e, err := NewMultiOpenVPNExporter([]StatusSource{
+		{Name: "hung", Path: server.URL + "/status"},
+		{Name: "local", Path: filepath.Join("testdata", "server3.status"), Timeout: time.Minute},
+	}, Options{DisableGeoIP: true, SourceTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	expected := `
+# HELP openvpn_collect_error Set when collecting the status source failed, labeled with the reason.
+# TYPE openvpn_collect_error gauge
+openvpn_collect_error{reason="timeout",server_name="hung"} 1
+# HELP openvpn_collect_success Whether collecting the status source was successful.
+# TYPE openvpn_collect_success gauge
+openvpn_collect_success{server_name="hung"} 0
+openvpn_collect_success{server_name="local"} 1
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "openvpn_collect_error", "openvpn_collect_success"); err != nil {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the hung source to be given up on, took %v", elapsed)
+	}
+}
+
+func TestMultipleStatusSourcesRejectsDuplicateNames(t *testing.T) {
+	_, err := NewMultiOpenVPNExporter([]StatusSource{
+		{Path: filepath.Join("testdata", "server2.status")},
+		{Path: filepath.Join("testdata", "server2.status")},
+	}, Options{DisableGeoIP: true})
+	if err == nil {
+		t.Error("expected an error for sources with the same name")
+	}
+}
+
+func TestStatusPathPattern(t *testing.T) {
+	dir := t.TempDir()
+	status, err := ioutil.ReadFile(filepath.Join("testdata", "server2.status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewMultiOpenVPNExporter([]StatusSource{
+		{Path: filepath.Join(dir, "*.status")},
+		// Also matched by the pattern, but collected once.
+		{Name: "udp", Path: filepath.Join(dir, "udp.status")},
+	}, Options{DisableGeoIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		create, remove string
+		sources        int
+	}{
+		{"udp.status", "", 1},
+		{"tcp.status", "", 2},
+		{"tcp2.status", "tcp.status", 2},
+		// The explicitly configured source is still collected, and
+		// fails.
+		{"", "udp.status", 2},
+	} {
+		if step.create != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, step.create), status, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if step.remove != "" {
+			if err := os.Remove(filepath.Join(dir, step.remove)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sources := gatherCount(t, e, "openvpn_up"); sources != step.sources {
+			t.Errorf("expected %d sources after creating %q and removing %q, got %d", step.sources, step.create, step.remove, sources)
+		}
+	}
+	if name := gatherLabel(t, e, "openvpn_server_connected_clients", "server_name"); name != filepath.Join(dir, "tcp2.status") {
+		t.Errorf("expected the matching file to be named after its path, got %q", name)
+	}
+}
+
+func TestStatusPathPatternRejectsMalformedPatterns(t *testing.T) {
+	if _, err := NewOpenVPNExporter("testdata/[server.status", Options{DisableGeoIP: true}); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
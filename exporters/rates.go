@@ -0,0 +1,58 @@
+package exporters
+
+import (
+	"sync"
+	"time"
+)
+
+// Byte counts of a client as seen during a scrape.
+type trafficSample struct {
+	received   float64
+	sent       float64
+	at         time.Time
+	generation uint64
+}
+
+// Remembers the byte counts of every client between scrapes, to derive
+// their throughput. Clients are keyed on common name and real address.
+type clientRates struct {
+	mutex      sync.Mutex
+	samples    map[string]trafficSample
+	generation uint64
+}
+
+func newClientRates() *clientRates {
+	return &clientRates{samples: map[string]trafficSample{}}
+}
+
+// Records the byte counts of a client and returns its receive and send
+// rates in bytes per second since the previous sample. Returns false if
+// the client was not seen before. Counters going down, as happens when
+// a client reconnects, yield rates of zero for the interval.
+func (r *clientRates) update(key string, received float64, sent float64, now time.Time) (float64, float64, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous, ok := r.samples[key]
+	r.samples[key] = trafficSample{received: received, sent: sent, at: now, generation: r.generation}
+	elapsed := now.Sub(previous.at).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0, 0, false
+	}
+	if received < previous.received || sent < previous.sent {
+		return 0, 0, true
+	}
+	return (received - previous.received) / elapsed, (sent - previous.sent) / elapsed, true
+}
+
+// Forgets the clients that were not seen since the previous call, so
+// that disconnected clients don't accumulate.
+func (r *clientRates) prune() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, sample := range r.samples {
+		if sample.generation != r.generation {
+			delete(r.samples, key)
+		}
+	}
+	r.generation++
+}
@@ -0,0 +1,75 @@
+package exporters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Timeout of fetching a status over HTTP, including connecting.
+const remoteStatusTimeout = 30 * time.Second
+
+// Client fetching statuses over HTTP, which is replaced in tests.
+var statusHTTPClient = &http.Client{}
+
+// Returned when a status fetched over HTTP didn't change since it was
+// fetched with the given validators.
+var errStatusNotModified = errors.New("status not modified")
+
+// Validators of a status fetched over HTTP, with which later requests
+// only fetch it again if it changed.
+type remoteValidators struct {
+	etag         string
+	lastModified string
+}
+
+// Whether a status path is an http:// or https:// URL.
+func isRemoteStatus(statusPath string) bool {
+	u, err := url.Parse(statusPath)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// Fetches a status from an http:// or https:// URL, such as that of a
+// file server on the VPN gateway, authenticating with the bearer token
+// if one is given. Returns errStatusNotModified if the server reports
+// the status unchanged since it had the given validators.
+func fetchRemoteStatus(ctx context.Context, rawURL string, token string, since remoteValidators) ([]byte, remoteValidators, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteStatusTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, remoteValidators{}, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if since.etag != "" {
+		req.Header.Set("If-None-Match", since.etag)
+	}
+	if since.lastModified != "" {
+		req.Header.Set("If-Modified-Since", since.lastModified)
+	}
+	resp, err := statusHTTPClient.Do(req)
+	if err != nil {
+		return nil, remoteValidators{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && since != (remoteValidators{}) {
+		return nil, since, errStatusNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, remoteValidators{}, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	status, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, remoteValidators{}, err
+	}
+	return status, remoteValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
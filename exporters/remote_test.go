@@ -0,0 +1,119 @@
+package exporters
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves a status file over HTTPS to requests carrying the bearer token.
+func serveRemoteStatus(t *testing.T, statusFile string, token string) *httptest.Server {
+	t.Helper()
+	status, err := ioutil.ReadFile(statusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(status)
+	}))
+	t.Cleanup(server.Close)
+	original := statusHTTPClient
+	statusHTTPClient = server.Client()
+	t.Cleanup(func() { statusHTTPClient = original })
+	return server
+}
+
+func TestCollectRemoteStatus(t *testing.T) {
+	server := serveRemoteStatus(t, filepath.Join("testdata", "server3.status"), "secret")
+
+	e, err := NewOpenVPNExporter(server.URL+"/status", Options{
+		GeoProvider:       fakeGeoProvider{},
+		ServerName:        "testdata/server3.status",
+		StatusBearerToken: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, e, "server3.metrics")
+}
+
+func TestCollectRemoteStatusFailure(t *testing.T) {
+	server := serveRemoteStatus(t, filepath.Join("testdata", "server3.status"), "secret")
+
+	for _, test := range []struct {
+		path  string
+		token string
+	}{
+		{path: "/status", token: "wrong"},
+		{path: "/nonexistent", token: "secret"},
+	} {
+		e, err := NewOpenVPNExporter(server.URL+test.path, Options{DisableGeoIP: true, StatusBearerToken: test.token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := gatherLabel(t, e, "openvpn_collect_error", "reason"); reason != "open" {
+			t.Errorf("%s: expected the scrape to fail opening the status, got reason %q", test.path, reason)
+		}
+	}
+}
+
+func TestCacheUnchangedRemoteStatus(t *testing.T) {
+	status, err := ioutil.ReadFile(filepath.Join("testdata", "server3.status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	modTime := time.Date(2017, 3, 21, 10, 39, 14, 0, time.UTC)
+	fetches := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// Counts the responses carrying the status.
+		if r.Header.Get("If-Modified-Since") != modTime.Format(http.TimeFormat) {
+			fetches++
+		}
+		http.ServeContent(w, r, "status", modTime, bytes.NewReader(status))
+	}))
+	defer server.Close()
+	original := statusHTTPClient
+	statusHTTPClient = server.Client()
+	defer func() { statusHTTPClient = original }()
+
+	e, err := NewOpenVPNExporter(server.URL+"/status", Options{DisableGeoIP: true, CacheUnchangedStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if count := gatherCount(t, e, "openvpn_server_client_received_bytes_total"); count != 5 {
+			t.Errorf("scrape %d: expected 5 clients, got %d", i, count)
+		}
+	}
+	mutex.Lock()
+	if fetches != 1 {
+		t.Errorf("expected the unchanged status to be fetched once, got %d", fetches)
+	}
+	// A rewrite is fetched again.
+	modTime = modTime.Add(time.Minute)
+	mutex.Unlock()
+	if count := gatherCount(t, e, "openvpn_server_client_received_bytes_total"); count != 5 {
+		t.Errorf("expected 5 clients, got %d", count)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fetches != 2 {
+		t.Errorf("expected the rewritten status to be fetched again, got %d fetches", fetches)
+	}
+}
@@ -0,0 +1,312 @@
+package exporters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default number of status sources collected at once.
+const defaultSourceConcurrency = 8
+
+// StatusSource is a status file or management interface collected by an
+// exporter.
+type StatusSource struct {
+	// Path of the status file, URL of the management interface, or
+	// ssh://, http:// or https:// URL of a status file on another host,
+	// or of the API of Access Server, OPNsense or pfSense. A
+	// path holding a glob pattern, such as /run/openvpn/*.status, is
+	// expanded on every scrape, and each file matching it is collected
+	// as a source named after its path.
+	Path string
+	// Name identifying the source in the server_name label. Defaults to
+	// the path, with any management password redacted.
+	Name string
+	// Location of the server, exported as its geo labels and used for
+	// client distances instead of the location resolved by GeoIP. Nil
+	// by default.
+	Location *GeoIP
+	// Values of the extra server labels named by the ServerLabels
+	// option. Labels not given are exported empty.
+	Labels map[string]string
+	// Time after which collecting the source is given up on, overriding
+	// the SourceTimeout option. Zero uses the option.
+	Timeout time.Duration
+}
+
+// A status source along with the state kept between its scrapes.
+type statusSource struct {
+	StatusSource
+	cache     *statusCache
+	rates     *clientRates
+	lifetimes *clientLifetimes
+	// Bandwidth of the clients of a management interface, notified in
+	// the background until stopBandwidth is called.
+	bandwidth     *clientBandwidth
+	stopBandwidth context.CancelFunc
+	// Sources of the files matching a glob pattern path, indexed by
+	// path, which keep their state while they match.
+	matchesMutex sync.Mutex
+	matches      map[string]*statusSource
+}
+
+// Whether a status path is a glob pattern rather than a single file or
+// management interface URL.
+func isStatusPattern(path string) bool {
+	if u, err := url.Parse(path); err == nil && u.Scheme != "" {
+		return false
+	}
+	return strings.ContainsAny(path, "*?[")
+}
+
+// Returns a status source with the state required by the exporter's
+// options.
+func (e *OpenVPNExporter) newStatusSource(source StatusSource) *statusSource {
+	if source.Name == "" {
+		source.Name = redactStatusPath(source.Path)
+	}
+	s := &statusSource{StatusSource: source}
+	if isStatusPattern(source.Path) {
+		s.matches = map[string]*statusSource{}
+		return s
+	}
+	if e.options.CacheUnchangedStatus {
+		s.cache = &statusCache{}
+	}
+	if e.options.ClientRates {
+		s.rates = newClientRates()
+	}
+	if e.options.ClientLifetimeTotals {
+		s.lifetimes = newClientLifetimes()
+	}
+	return s
+}
+
+// SetStatusSources replaces the exporter's status sources, as when its
+// configuration is reloaded. Sources that are unchanged keep their
+// state, such as cached metrics and client rates, so that reloading
+// doesn't disturb them. Returns an error, keeping the current sources,
+// if there are none, names are duplicated, a glob pattern is malformed
+// or a label isn't one of the ServerLabels.
+func (e *OpenVPNExporter) SetStatusSources(sources []StatusSource) error {
+	if len(sources) == 0 {
+		return errors.New("no status sources given")
+	}
+	e.sourcesMutex.Lock()
+	defer e.sourcesMutex.Unlock()
+	current := map[string]*statusSource{}
+	for _, source := range e.sources {
+		current[source.Name] = source
+	}
+	known := map[string]bool{}
+	for _, name := range e.options.ServerLabels {
+		known[name] = true
+	}
+	var replaced []*statusSource
+	names := map[string]bool{}
+	for _, source := range sources {
+		if isStatusPattern(source.Path) {
+			if _, err := filepath.Match(source.Path, ""); err != nil {
+				return fmt.Errorf("invalid status path pattern %q: %v", source.Path, err)
+			}
+		}
+		for name := range source.Labels {
+			if !known[name] {
+				return fmt.Errorf("label %q of status source %q isn't one of the server labels", name, source.Name)
+			}
+		}
+		s := e.newStatusSource(source)
+		if names[s.Name] {
+			return fmt.Errorf("duplicate status source name: %q", s.Name)
+		}
+		names[s.Name] = true
+		if existing, ok := current[s.Name]; ok && reflect.DeepEqual(existing.StatusSource, s.StatusSource) {
+			s = existing
+		}
+		replaced = append(replaced, s)
+	}
+
+	kept := map[*statusSource]bool{}
+	for _, source := range replaced {
+		kept[source] = true
+		if source.bandwidth == nil {
+			e.startBandwidth(source)
+		}
+	}
+	for _, source := range e.sources {
+		if !kept[source] && source.stopBandwidth != nil {
+			source.stopBandwidth()
+		}
+	}
+	e.sources = replaced
+	return nil
+}
+
+// Subscribes to the bytecount notifications of a management interface
+// source in the background, if configured.
+func (e *OpenVPNExporter) startBandwidth(source *statusSource) {
+	u, err := url.Parse(source.Path)
+	if err != nil || (u.Scheme != "tcp" && u.Scheme != "unix") || e.options.ManagementBytecountInterval <= 0 {
+		return
+	}
+	source.bandwidth = newClientBandwidth(e.options.ManagementBytecountInterval)
+	var ctx context.Context
+	ctx, source.stopBandwidth = context.WithCancel(e.backgroundCtx)
+	e.background.Add(1)
+	go e.watchBytecount(ctx, source, u)
+}
+
+// Returns the time after which collecting a status source is given up
+// on, or zero if it isn't limited.
+func (e *OpenVPNExporter) sourceTimeout(source *statusSource) time.Duration {
+	if source.Timeout > 0 {
+		return source.Timeout
+	}
+	return e.options.SourceTimeout
+}
+
+// Collects the status of a source, through its cache if enabled. Returns
+// whether the metrics of the previous scrape were exported.
+func (e *OpenVPNExporter) collectStatus(ctx context.Context, source *statusSource, ch chan<- prometheus.Metric) (bool, error) {
+	if source.cache != nil {
+		return e.collectStatusCached(ctx, source, ch)
+	}
+	return false, e.collectStatusFromFile(ctx, source, ch)
+}
+
+// Collects the status of a source, giving up once the timeout passes.
+// As reads of local files can't be interrupted, the status is collected
+// in the background, which carries on until the read returns, and its
+// metrics are only sent once it completed in time, so that a source
+// timing out doesn't export partial metrics.
+func (e *OpenVPNExporter) collectStatusWithTimeout(ctx context.Context, source *statusSource, timeout time.Duration, ch chan<- prometheus.Metric) (bool, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	metrics := make(chan prometheus.Metric)
+	type result struct {
+		cached bool
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cached, err := e.collectStatus(timeoutCtx, source, metrics)
+		close(metrics)
+		done <- result{cached, err}
+	}()
+	timedOut := func() (bool, error) {
+		if ctx.Err() != nil {
+			return false, &collectError{reason: "canceled", err: ctx.Err()}
+		}
+		return false, &collectError{reason: "timeout", err: fmt.Errorf("collecting the status took longer than %v", timeout)}
+	}
+	var buffered []prometheus.Metric
+	for {
+		select {
+		case metric, ok := <-metrics:
+			if ok {
+				buffered = append(buffered, metric)
+				continue
+			}
+			r := <-done
+			if r.err != nil && timeoutCtx.Err() != nil {
+				return timedOut()
+			}
+			for _, metric := range buffered {
+				ch <- metric
+			}
+			return r.cached, r.err
+		case <-timeoutCtx.Done():
+			go func() {
+				for range metrics {
+				}
+			}()
+			return timedOut()
+		}
+	}
+}
+
+// Returns the configured status sources.
+func (e *OpenVPNExporter) statusSources() []*statusSource {
+	e.sourcesMutex.RLock()
+	defer e.sourcesMutex.RUnlock()
+	return e.sources
+}
+
+// Returns the sources to collect: the configured sources, with glob
+// patterns replaced by the files currently matching them. Files matching
+// several patterns, or also configured by their path, are collected once.
+func (e *OpenVPNExporter) expandSources() []*statusSource {
+	var expanded []*statusSource
+	paths := map[string]bool{}
+	sources := e.statusSources()
+	for _, source := range sources {
+		if source.matches == nil {
+			paths[source.Path] = true
+			expanded = append(expanded, source)
+		}
+	}
+	for _, source := range sources {
+		if source.matches == nil {
+			continue
+		}
+		for _, match := range e.expandPattern(source) {
+			if !paths[match.Path] {
+				paths[match.Path] = true
+				expanded = append(expanded, match)
+			}
+		}
+	}
+	return expanded
+}
+
+// Returns the sources of the files matching a glob pattern source, in
+// the order of their paths. Files that no longer match are forgotten.
+func (e *OpenVPNExporter) expandPattern(source *statusSource) []*statusSource {
+	paths, err := filepath.Glob(source.Path)
+	if err != nil {
+		e.logger.Warnf("Error expanding status path %s: %v", source.Path, err)
+		return nil
+	}
+	sort.Strings(paths)
+	source.matchesMutex.Lock()
+	defer source.matchesMutex.Unlock()
+	matches := make(map[string]*statusSource, len(paths))
+	var expanded []*statusSource
+	for _, path := range paths {
+		match, ok := source.matches[path]
+		if !ok {
+			e.logger.Debugf("Collecting %s, matching %s", path, source.Path)
+			match = e.newStatusSource(StatusSource{Path: path, Location: source.Location, Labels: source.Labels, Timeout: source.Timeout})
+		}
+		matches[path] = match
+		expanded = append(expanded, match)
+	}
+	source.matches = matches
+	return expanded
+}
+
+// Returns the exporter's status sources at the given path, expanded if
+// it is a glob pattern, or else a new one.
+func (e *OpenVPNExporter) statusSourcesAt(path string) []*statusSource {
+	for _, source := range e.statusSources() {
+		if source.Path == path && source.matches != nil {
+			return e.expandPattern(source)
+		} else if source.Path == path {
+			return []*statusSource{source}
+		}
+	}
+	source := e.newStatusSource(StatusSource{Path: path})
+	if source.matches != nil {
+		return e.expandPattern(source)
+	}
+	return []*statusSource{source}
+}
@@ -0,0 +1,57 @@
+package exporters
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Timeout of reading a status file over SSH, including connecting.
+const sshTimeout = 30 * time.Second
+
+// Command run to read status files over SSH, which is replaced in tests.
+var sshCommand = "ssh"
+
+// Reads a status file on a remote host, given as an
+// ssh://[user@]host[:port]/path URL, by running cat over the ssh
+// command. Authentication is limited to keys, as there is no one to
+// enter a password, and the host key must be known, as configured for
+// the user running the exporter.
+func readSSHStatus(ctx context.Context, u *url.URL, identityFile string) ([]byte, error) {
+	args := []string{"-o", "BatchMode=yes", "-o", fmt.Sprintf("ConnectTimeout=%d", int(managementTimeout.Seconds()))}
+	if identityFile != "" {
+		args = append(args, "-i", identityFile)
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	host := u.Hostname()
+	if u.User != nil && u.User.Username() != "" {
+		host = u.User.Username() + "@" + host
+	}
+	args = append(args, "--", host, "cat", shellQuote(u.Path))
+
+	ctx, cancel := context.WithTimeout(ctx, sshTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, sshCommand, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	status, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+	return status, nil
+}
+
+// Quotes a string for a POSIX shell, as remote commands are run by the
+// login shell of the user.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
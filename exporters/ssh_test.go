@@ -0,0 +1,77 @@
+package exporters
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Replaces the ssh command by a script recording its arguments and
+// running the remote command locally.
+func fakeSSH(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" > " + shellQuote(argsFile) + "\n" +
+		"while [ \"$1\" != -- ]; do shift; done\n" +
+		"shift 2\n" +
+		"eval \"$@\"\n"
+	path := filepath.Join(dir, "ssh")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	original := sshCommand
+	sshCommand = path
+	t.Cleanup(func() { sshCommand = original })
+	return argsFile
+}
+
+func TestCollectSSHStatus(t *testing.T) {
+	argsFile := fakeSSH(t)
+	// A path the remote shell must not split.
+	dir := filepath.Join(t.TempDir(), "open vpn")
+	status, err := ioutil.ReadFile(filepath.Join("testdata", "server3.status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.status"), status, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewOpenVPNExporter("ssh://monitor@vpn.example.com:2222"+filepath.Join(dir, "server.status"), Options{
+		GeoProvider:     fakeGeoProvider{},
+		ServerName:      "testdata/server3.status",
+		SSHIdentityFile: "/etc/openvpn_exporter/id_ed25519",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, e, "server3.metrics")
+
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"BatchMode=yes", "-i /etc/openvpn_exporter/id_ed25519", "-p 2222", "-- monitor@vpn.example.com cat"} {
+		if !strings.Contains(string(args), expected) {
+			t.Errorf("expected ssh arguments containing %q, got %q", expected, args)
+		}
+	}
+}
+
+func TestCollectSSHStatusFailure(t *testing.T) {
+	fakeSSH(t)
+	e, err := NewOpenVPNExporter("ssh://vpn.example.com/nonexistent/server.status", Options{DisableGeoIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := gatherLabel(t, e, "openvpn_collect_error", "reason"); reason != "open" {
+		t.Errorf("expected the scrape to fail opening the status, got reason %q", reason)
+	}
+}
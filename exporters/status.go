@@ -0,0 +1,463 @@
+package exporters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerStatus holds the status of an OpenVPN server, as parsed by
+// ParseServerStatus.
+type ServerStatus struct {
+	// Version of the server, which the version 1 format lacks.
+	Title string
+	// Time at which the server last updated its status.
+	UpdateTime time.Time
+	// Whether the status ends with the END footer. A status lacking it
+	// may have been truncated while being written.
+	Complete bool
+	// Connected clients, in the order they are listed.
+	Clients []ClientSession
+	// Routes to the clients, in the order they are listed.
+	Routes []Route
+	// GLOBAL_STATS entries, indexed by key.
+	GlobalStats map[string]string
+
+	// Entries of the client list and routing table, from which both
+	// the clients and routes and the exporter's metrics are derived.
+	entries []serverEntry
+}
+
+// Version returns the OpenVPN version named in the title, such as 2.4.7,
+// or an empty string if the title doesn't start with one.
+func (status *ServerStatus) Version() string {
+	fields := strings.Fields(status.Title)
+	if len(fields) < 2 || fields[0] != "OpenVPN" {
+		return ""
+	}
+	version := fields[1]
+	if version == "" || version[0] < '0' || version[0] > '9' {
+		return ""
+	}
+	return version
+}
+
+// ClientSession is a session of a client, as listed in the client list
+// of a server status. Columns that the status format lacks are left
+// empty.
+type ClientSession struct {
+	CommonName         string
+	RealAddress        string
+	VirtualAddress     string
+	VirtualIPv6Address string
+	Username           string
+	ClientID           string
+	PeerID             string
+	DataChannelCipher  string
+	BytesReceived      uint64
+	BytesSent          uint64
+	ConnectedSince     time.Time
+	// Location of the real address, only set by
+	// OpenVPNExporter.ResolveClientGeo.
+	Geo *GeoIP
+}
+
+// Route is an entry of the routing table of a server status.
+type Route struct {
+	VirtualAddress string
+	CommonName     string
+	RealAddress    string
+	LastRef        time.Time
+}
+
+// Columns of the CLIENT_LIST and ROUTING_TABLE that the exporter knows
+// of, as listed by the HEADER lines of OpenVPN 2.3 to 2.6. Other columns,
+// as added by later releases, are ignored.
+var knownStatusColumns = map[string]map[string]bool{
+	"CLIENT_LIST": {
+		"Common Name":              true,
+		"Real Address":             true,
+		"Virtual Address":          true,
+		"Virtual IPv6 Address":     true,
+		"Bytes Received":           true,
+		"Bytes Sent":               true,
+		"Connected Since":          true,
+		"Connected Since (time_t)": true,
+		"Username":                 true,
+		"Client ID":                true,
+		"Peer ID":                  true,
+		"Data Channel Cipher":      true,
+		"TLS Version":              true,
+	},
+	"ROUTING_TABLE": {
+		"Virtual Address":   true,
+		"Common Name":       true,
+		"Real Address":      true,
+		"Last Ref":          true,
+		"Last Ref (time_t)": true,
+	},
+}
+
+// Entry of a CLIENT_LIST or ROUTING_TABLE. Entries are exported once the
+// whole status is read, so that their GeoIP data can be resolved in
+// batches. To keep memory bounded on servers with many clients, they
+// hold just their fields and share the column names of their HEADER.
+type serverEntry struct {
+	kind        string
+	columnNames []string
+	fields      []string
+}
+
+// Returns the value of a column of the entry, or an empty string if the
+// entry lacks the column.
+func (entry serverEntry) value(column string) string {
+	for i, name := range entry.columnNames {
+		if name == column {
+			return entry.fields[i]
+		}
+	}
+	return ""
+}
+
+// ParseServerStatus parses an OpenVPN server status in any of the
+// version 1, 2 and 3 formats, without exporting any metrics. Malformed
+// lines are skipped.
+func ParseServerStatus(r io.Reader) (*ServerStatus, error) {
+	status, err := parseServerStatus(context.Background(), newStatusReader(r), StatusFormatAuto, func(error) {})
+	if err != nil {
+		return nil, err
+	}
+	status.parseEntries()
+	return status, nil
+}
+
+// UTF-8 byte order mark, which may precede status files on Windows.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// Returns a buffered reader of a status, skipping the byte order mark
+// written by some Windows editors.
+func newStatusReader(r io.Reader) *bufio.Reader {
+	reader := bufio.NewReader(r)
+	if bom, _ := reader.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		reader.Discard(len(utf8BOM))
+	}
+	return reader
+}
+
+// Splits a status into lines like bufio.ScanLines, but also strips any
+// carriage returns remaining at the end of a line, as OpenVPN on Windows
+// writes CRLF line endings.
+func scanStatusLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	return advance, bytes.TrimRight(token, "\r"), err
+}
+
+// Splits a status line into its fields. Fields holding the separator,
+// such as common names with commas, are quoted as in CSV.
+func splitStatusLine(line string, separator string) []string {
+	if !strings.Contains(line, `"`) {
+		return strings.Split(line, separator)
+	}
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = rune(separator[0])
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	fields, err := reader.Read()
+	if err != nil {
+		return strings.Split(line, separator)
+	}
+	return fields
+}
+
+// Status formats that can be forced instead of detecting them from the
+// first line of the status, for tools that don't write it exactly as
+// OpenVPN does.
+const (
+	StatusFormatAuto   = ""
+	StatusFormatV1     = "v1"
+	StatusFormatV2     = "v2"
+	StatusFormatV3     = "v3"
+	StatusFormatClient = "client"
+)
+
+// Checks that a status format is known.
+func validateStatusFormat(format string) error {
+	switch format {
+	case StatusFormatAuto, StatusFormatV1, StatusFormatV2, StatusFormatV3, StatusFormatClient:
+		return nil
+	}
+	return fmt.Errorf("unknown status format: %q", format)
+}
+
+// Parses a server status into its raw entries, in the given format
+// version or else the one detected. Malformed lines are passed to skip.
+func parseServerStatus(ctx context.Context, reader *bufio.Reader, format string, skip func(error)) (*ServerStatus, error) {
+	status := &ServerStatus{GlobalStats: map[string]string{}}
+	var err error
+	buf, _ := reader.Peek(19)
+	if format == StatusFormatV2 {
+		err = parseServerStatusV2(ctx, reader, ",", status, skip)
+	} else if format == StatusFormatV3 {
+		err = parseServerStatusV2(ctx, reader, "\t", status, skip)
+	} else if format == StatusFormatV1 {
+		err = parseServerStatusV1(ctx, reader, status, skip)
+	} else if bytes.HasPrefix(buf, []byte("TITLE,")) {
+		// Server statistics, using format version 2.
+		err = parseServerStatusV2(ctx, reader, ",", status, skip)
+	} else if bytes.HasPrefix(buf, []byte("TITLE\t")) {
+		// Server statistics, using format version 3. The only
+		// difference compared to version 2 is that it uses tabs
+		// instead of spaces.
+		err = parseServerStatusV2(ctx, reader, "\t", status, skip)
+	} else if bytes.HasPrefix(buf, []byte("OpenVPN CLIENT LIST")) {
+		// Server statistics, using the legacy format version 1.
+		err = parseServerStatusV1(ctx, reader, status, skip)
+	} else {
+		return nil, &collectError{reason: "format", err: fmt.Errorf("unexpected file contents: %q", buf)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Derives the clients and routes from the entries of the status. The
+// exporter skips this, exporting the entries directly.
+func (status *ServerStatus) parseEntries() {
+	for _, entry := range status.entries {
+		switch entry.kind {
+		case "CLIENT_LIST":
+			status.Clients = append(status.Clients, ClientSession{
+				CommonName:         entry.value("Common Name"),
+				RealAddress:        entry.value("Real Address"),
+				VirtualAddress:     entry.value("Virtual Address"),
+				VirtualIPv6Address: entry.value("Virtual IPv6 Address"),
+				Username:           entry.value("Username"),
+				ClientID:           entry.value("Client ID"),
+				PeerID:             entry.value("Peer ID"),
+				DataChannelCipher:  entry.value("Data Channel Cipher"),
+				BytesReceived:      parseStatusCount(entry.value("Bytes Received")),
+				BytesSent:          parseStatusCount(entry.value("Bytes Sent")),
+				ConnectedSince:     parseStatusUnixTime(entry.value("Connected Since (time_t)")),
+			})
+		case "ROUTING_TABLE":
+			status.Routes = append(status.Routes, Route{
+				VirtualAddress: entry.value("Virtual Address"),
+				CommonName:     entry.value("Common Name"),
+				RealAddress:    entry.value("Real Address"),
+				LastRef:        parseStatusUnixTime(entry.value("Last Ref (time_t)")),
+			})
+		}
+	}
+}
+
+// Parses a byte count of a status, returning zero if it is malformed.
+func parseStatusCount(value string) uint64 {
+	count, _ := strconv.ParseUint(strings.ReplaceAll(value, ",", ""), 10, 64)
+	return count
+}
+
+// Parses a UNIX time of a status, returning the zero time if it is
+// malformed.
+func parseStatusUnixTime(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// Parses a server status in the version 2 or 3 format, in which HEADER
+// lines name the columns of the client list and routing table.
+func parseServerStatusV2(ctx context.Context, file io.Reader, separator string, status *ServerStatus, skip func(error)) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Split(scanStatusLines)
+	headersFound := map[string][]string{}
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return &collectError{reason: "canceled", err: err}
+		}
+		fields := splitStatusLine(scanner.Text(), separator)
+		if fields[0] == "END" && len(fields) == 1 {
+			// Stats footer.
+			status.Complete = true
+		} else if fields[0] == "GLOBAL_STATS" {
+			// Global server statistics.
+			if len(fields) != 3 {
+				skip(fmt.Errorf("GLOBAL_STATS entry should have a key and a value: %q", scanner.Text()))
+				continue
+			}
+			status.GlobalStats[fields[1]] = fields[2]
+		} else if fields[0] == "HEADER" && len(fields) > 2 {
+			// Column names for CLIENT_LIST and ROUTING_TABLE.
+			headersFound[fields[1]] = fields[2:]
+		} else if fields[0] == "TIME" && len(fields) == 3 {
+			// Time at which the statistics were updated.
+			timeStartStats, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				skip(err)
+				continue
+			}
+			status.UpdateTime = time.Unix(int64(timeStartStats), 0)
+		} else if fields[0] == "TITLE" && len(fields) == 2 {
+			// OpenVPN version number.
+			status.Title = fields[1]
+		} else if fields[0] == "CLIENT_LIST" || fields[0] == "ROUTING_TABLE" {
+			// Entry that depends on a preceding HEADERS directive.
+			columnNames, ok := headersFound[fields[0]]
+			if !ok {
+				skip(fmt.Errorf("%s should be preceded by HEADERS", fields[0]))
+				continue
+			}
+			if len(fields) != len(columnNames)+1 {
+				skip(fmt.Errorf("HEADER for %s describes a different number of columns", fields[0]))
+				continue
+			}
+
+			status.entries = append(status.entries, serverEntry{kind: fields[0], columnNames: columnNames, fields: fields[1:]})
+		} else {
+			skip(fmt.Errorf("unsupported key: %q", fields[0]))
+		}
+	}
+	return scanner.Err()
+}
+
+// Columns of the version 1 format holding human readable timestamps,
+// mapped to the columns of the version 2 and 3 formats holding the
+// same timestamps as UNIX time.
+var v1TimeColumns = map[string]string{
+	"Connected Since": "Connected Since (time_t)",
+	"Last Ref":        "Last Ref (time_t)",
+}
+
+// Parses a server status in the legacy version 1 format. Instead of
+// HEADER lines, this format has sections for the client list and
+// routing table, each starting with a line of fixed column names.
+func parseServerStatusV1(ctx context.Context, file io.Reader, status *ServerStatus, skip func(error)) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Split(scanStatusLines)
+
+	// The client list comes first, even if its section header is missing.
+	section := "CLIENT_LIST"
+	var columnNames []string
+	// Positions of the human readable timestamps within the section,
+	// whose UNIX time is appended to each entry.
+	var timeIndexes []int
+lines:
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return &collectError{reason: "canceled", err: err}
+		}
+		line := scanner.Text()
+		fields := splitStatusLine(line, ",")
+		if line == "END" {
+			// Stats footer.
+			status.Complete = true
+		} else if line == "OpenVPN CLIENT LIST" {
+			section, columnNames = "CLIENT_LIST", nil
+		} else if line == "ROUTING TABLE" {
+			section, columnNames = "ROUTING_TABLE", nil
+		} else if line == "GLOBAL STATS" {
+			section, columnNames = "GLOBAL_STATS", nil
+		} else if fields[0] == "Updated" && len(fields) == 2 {
+			// Time at which the statistics were updated.
+			timeParser, err := parseStatusTime(fields[1])
+			if err != nil {
+				skip(err)
+				continue
+			}
+			status.UpdateTime = timeParser
+		} else if section == "GLOBAL_STATS" {
+			// Global server statistics.
+			if len(fields) != 2 {
+				skip(fmt.Errorf("GLOBAL STATS entry should have a key and a value: %q", line))
+				continue
+			}
+			status.GlobalStats[fields[0]] = fields[1]
+		} else if section == "CLIENT_LIST" || section == "ROUTING_TABLE" {
+			if columnNames == nil {
+				// First line of a section holds the column names, to
+				// which those of the newer formats' timestamps are added.
+				columnNames, timeIndexes = fields, nil
+				for i, column := range fields {
+					if timeColumn, ok := v1TimeColumns[column]; ok {
+						columnNames = append(columnNames, timeColumn)
+						timeIndexes = append(timeIndexes, i)
+					}
+				}
+				continue
+			}
+			if len(fields) != len(columnNames)-len(timeIndexes) {
+				skip(fmt.Errorf("%s entry has a different number of columns than its section", section))
+				continue
+			}
+
+			for _, i := range timeIndexes {
+				t, err := parseStatusTime(fields[i])
+				if err != nil {
+					skip(err)
+					continue lines
+				}
+				fields = append(fields, strconv.FormatInt(t.Unix(), 10))
+			}
+			status.entries = append(status.entries, serverEntry{kind: section, columnNames: columnNames, fields: fields})
+		} else {
+			skip(fmt.Errorf("unsupported line: %q", line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	addV1VirtualAddresses(status)
+	return nil
+}
+
+// Adds the virtual addresses of clients, which the client list of the
+// version 1 format lacks, taken from their routes to single addresses
+// rather than to the subnets behind them.
+func addV1VirtualAddresses(status *ServerStatus) {
+	type addresses struct{ v4, v6 string }
+	routes := map[string]*addresses{}
+	for _, entry := range status.entries {
+		address := entry.value("Virtual Address")
+		if entry.kind != "ROUTING_TABLE" || address == "" || strings.Contains(address, "/") {
+			continue
+		}
+		key := clientSessionKey(entry)
+		if routes[key] == nil {
+			routes[key] = &addresses{}
+		}
+		if strings.Contains(address, ":") && routes[key].v6 == "" {
+			routes[key].v6 = address
+		} else if !strings.Contains(address, ":") && routes[key].v4 == "" {
+			routes[key].v4 = address
+		}
+	}
+
+	// Entries of a section share their column names, to which the
+	// virtual address columns are added once.
+	extended := map[*string][]string{}
+	for i, entry := range status.entries {
+		if entry.kind != "CLIENT_LIST" || len(entry.columnNames) == 0 {
+			continue
+		}
+		columnNames, ok := extended[&entry.columnNames[0]]
+		if !ok {
+			columnNames = append(entry.columnNames[:len(entry.columnNames):len(entry.columnNames)], "Virtual Address", "Virtual IPv6 Address")
+			extended[&entry.columnNames[0]] = columnNames
+		}
+		route := routes[clientSessionKey(entry)]
+		if route == nil {
+			route = &addresses{}
+		}
+		status.entries[i].columnNames = columnNames
+		status.entries[i].fields = append(entry.fields, route.v4, route.v6)
+	}
+}
@@ -0,0 +1,150 @@
+package exporters
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parses a status file in testdata.
+func parseTestStatus(t *testing.T, name string) *ServerStatus {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	status, err := ParseServerStatus(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestParseServerStatus(t *testing.T) {
+	status := parseTestStatus(t, "server2_openvpn26.status")
+	expected := &ServerStatus{
+		Title:      "OpenVPN 2.6.3 x86_64-pc-linux-gnu [SSL (OpenSSL)] [LZO] [LZ4] [EPOLL] [PKCS11] [MH/PKTINFO] [AEAD] [DCO]",
+		UpdateTime: time.Unix(1683822037, 0),
+		Complete:   true,
+		Clients: []ClientSession{{
+			CommonName:         "alice",
+			RealAddress:        "198.51.100.23:50112",
+			VirtualAddress:     "10.8.0.6",
+			VirtualIPv6Address: "fd00:8::1000",
+			Username:           "UNDEF",
+			ClientID:           "0",
+			PeerID:             "0",
+			DataChannelCipher:  "AES-256-GCM",
+			BytesReceived:      1851263,
+			BytesSent:          2741904,
+			ConnectedSince:     time.Unix(1683817364, 0),
+		}},
+		Routes: []Route{{
+			VirtualAddress: "10.8.0.6",
+			CommonName:     "alice",
+			RealAddress:    "198.51.100.23:50112",
+			LastRef:        time.Unix(1683822031, 0),
+		}},
+		GlobalStats: map[string]string{
+			"Max bcast/mcast queue length": "2",
+			"dco_enabled":                  "1",
+			"Some future statistic":        "7",
+		},
+	}
+	status.entries = nil
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestParseServerStatusV1(t *testing.T) {
+	status := parseTestStatus(t, "server1.status")
+	if len(status.Clients) != 2 || len(status.Routes) != 1 {
+		t.Fatalf("expected 2 clients and 1 route, got %+v", status)
+	}
+	// Human readable timestamps are converted like those of the newer
+	// formats.
+	if since := status.Clients[0].ConnectedSince; !since.Equal(time.Date(2015, 6, 18, 8, 11, 25, 0, time.UTC)) {
+		t.Errorf("unexpected connection time: %v", since)
+	}
+	if lastRef := status.Routes[0].LastRef; !lastRef.Equal(time.Date(2015, 6, 18, 8, 12, 9, 0, time.UTC)) {
+		t.Errorf("unexpected last reference time: %v", lastRef)
+	}
+	// Virtual addresses are taken from the routing table.
+	if address := status.Clients[0].VirtualAddress; address != "10.8.0.6" {
+		t.Errorf("expected the virtual address of the client's route, got %q", address)
+	}
+	if address := status.Clients[1].VirtualAddress; address != "" {
+		t.Errorf("expected no virtual address for a client without routes, got %q", address)
+	}
+}
+
+func TestParseServerStatusDualStackRoutes(t *testing.T) {
+	status := parseTestStatus(t, "server2_dual_stack.status")
+	var addresses []string
+	for _, route := range status.Routes {
+		addresses = append(addresses, route.VirtualAddress)
+	}
+	expected := []string{"10.8.0.6", "fd00:8::1000", "10.8.0.10", "fd00:8::1001", "192.168.10.0/24", "2001:db8:10::/64"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected routes %v, got %v", expected, addresses)
+	}
+}
+
+func TestParseServerStatusForcedV1(t *testing.T) {
+	// A version 1 status lacking its first line.
+	status := "Updated,Thu Jun 18 08:12:15 2015\n" +
+		"Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since\n" +
+		"redacted1,192.0.2.1:19021,305996,312184,Thu Jun 18 08:11:25 2015\n" +
+		"END\n"
+	parsed, err := parseServerStatus(context.Background(), newStatusReader(strings.NewReader(status)), StatusFormatV1, func(err error) {
+		t.Error(err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.entries) != 1 || parsed.entries[0].value("Common Name") != "redacted1" {
+		t.Errorf("expected the client to be parsed, got %+v", parsed.entries)
+	}
+}
+
+func TestServerStatusVersion(t *testing.T) {
+	for title, version := range map[string]string{
+		"OpenVPN 2.4.7 x86_64-pc-linux-gnu [SSL (OpenSSL)] [LZO]": "2.4.7",
+		"OpenVPN 2.6_git x86_64-w64-mingw32":                      "2.6_git",
+		"OpenVPN":                                                 "",
+		"":                                                        "",
+		"Custom status writer":                                    "",
+		"OpenVPN CLIENT LIST":                                     "",
+	} {
+		status := &ServerStatus{Title: title}
+		if got := status.Version(); got != version {
+			t.Errorf("expected version %q of title %q, got %q", version, title, got)
+		}
+	}
+}
+
+func TestParseServerStatusRejectsClientStatus(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "client.status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := ParseServerStatus(file); err == nil {
+		t.Error("expected an error for a client status")
+	}
+}
+
+func TestResolveClientGeo(t *testing.T) {
+	status := parseTestStatus(t, "server2_openvpn26.status")
+	e := newTestExporter(t, "server2_openvpn26.status", Options{})
+	e.ResolveClientGeo(context.Background(), status)
+	if geo := status.Clients[0].Geo; geo == nil || geo.City != "Amsterdam" {
+		t.Errorf("expected the client to be located in Amsterdam, got %+v", geo)
+	}
+}
@@ -0,0 +1,113 @@
+package exporters
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io"
+)
+
+// Collector of the metrics of status sources, remembering why collecting
+// the first failing one failed.
+type validateCollector struct {
+	exporter *OpenVPNExporter
+	sources  []*statusSource
+	err      error
+}
+
+func (c *validateCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c *validateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, source := range c.sources {
+		if err := c.exporter.collectStatusFromFile(context.Background(), source, ch); err != nil && c.err == nil {
+			c.err = fmt.Errorf("%s: %v", source.Name, err)
+		}
+	}
+}
+
+// Validate collects the status at the given path once and writes the
+// resulting metrics to w in the Prometheus text format, for checking a
+// status source without serving it. Returns an error if collecting the
+// status failed or any of its lines were malformed, after writing the
+// metrics that could be collected. Paths of the exporter's own status
+// sources are labeled with their name, and glob patterns are expanded.
+func (e *OpenVPNExporter) Validate(path string, w io.Writer) error {
+	collector := &validateCollector{exporter: e, sources: e.statusSourcesAt(path)}
+	if len(collector.sources) == 0 {
+		return fmt.Errorf("no status files match %s", path)
+	}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return err
+	}
+	skippedBefore := counterValue(e.statusParseErrors)
+	if err := writeMetrics(registry, w); err != nil {
+		return err
+	}
+	if collector.err != nil {
+		return collector.err
+	}
+	if skipped := counterValue(e.statusParseErrors) - skippedBefore; skipped > 0 {
+		return fmt.Errorf("skipped %v malformed status lines", skipped)
+	}
+	return nil
+}
+
+// Collector of all of the exporter's metrics, remembering why collecting
+// the first failing status source failed.
+type onceCollector struct {
+	exporter *OpenVPNExporter
+	err      error
+}
+
+func (c *onceCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c *onceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.err = c.exporter.collect(context.Background(), ch)
+}
+
+// CollectOnce collects every status source once, as a scrape would, and
+// writes the resulting metrics to w in the Prometheus text format, for
+// use with the textfile collector of the node exporter. Returns an error
+// if collecting any status source failed, after writing all metrics.
+func (e *OpenVPNExporter) CollectOnce(w io.Writer) error {
+	collector := &onceCollector{exporter: e}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return err
+	}
+	if err := writeMetrics(registry, w); err != nil {
+		return err
+	}
+	return collector.err
+}
+
+// Gathers the metrics of a registry and writes them to w in the
+// Prometheus text format.
+func writeMetrics(registry *prometheus.Registry, w io.Writer) error {
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the current value of a counter.
+func counterValue(counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		return 0
+	}
+	return metric.GetCounter().GetValue()
+}
@@ -0,0 +1,88 @@
+package exporters
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		status string
+		err    string
+		output string
+	}{
+		{"server2.status", "", "openvpn_server_connected_clients{"},
+		// The GLOBAL_STATS line lacking a key and value is skipped.
+		{"server2_openvpn26.status", "skipped 1 malformed status lines", `common_name="alice"`},
+		{"missing.status", "no such file or directory", ""},
+	} {
+		t.Run(test.status, func(t *testing.T) {
+			e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+			var buf bytes.Buffer
+			err := e.Validate("testdata/"+test.status, &buf)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+			if !strings.Contains(buf.String(), test.output) {
+				t.Errorf("expected output containing %q, got:\n%s", test.output, buf.String())
+			}
+		})
+	}
+}
+
+func TestValidateStdin(t *testing.T) {
+	status, err := os.Open("testdata/server2.status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Close()
+	defer func(original io.Reader) { stdin = original }(stdin)
+	stdin = status
+
+	e := newTestExporter(t, "server2.status", Options{DisableGeoIP: true})
+	var buf bytes.Buffer
+	if err := e.Validate("-", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `common_name="redacted1"`) {
+		t.Errorf("expected the clients of the status, got:\n%s", buf.String())
+	}
+}
+
+func TestCollectOnce(t *testing.T) {
+	status, err := os.Open("testdata/server2.status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Close()
+	defer func(original io.Reader) { stdin = original }(stdin)
+	stdin = status
+
+	e, err := NewOpenVPNExporter("-", Options{DisableGeoIP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.CollectOnce(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`common_name="redacted1"`, `openvpn_up{server_city="",server_country="",server_geohash="",server_name="-",server_public_ip="",server_region=""} 1`} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected output containing %q, got:\n%s", expected, buf.String())
+		}
+	}
+
+	e = newTestExporter(t, "missing.status", Options{DisableGeoIP: true})
+	buf.Reset()
+	if err := e.CollectOnce(&buf); err == nil || !strings.Contains(err.Error(), "no such file or directory") {
+		t.Errorf("expected an error for the missing status, got %v", err)
+	}
+	if !strings.Contains(buf.String(), `openvpn_collect_error{reason="open"`) {
+		t.Errorf("expected the failure to be exported, got:\n%s", buf.String())
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/notfromstatefarm/openvpn_exporter
 
-go 1.17
+go 1.18
 
 require (
 	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
@@ -8,10 +8,18 @@ require (
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/prometheus/client_golang v0.9.1
-	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910 // indirect
-	github.com/prometheus/common v0.0.0-20181020173914-7e9e6cabbd39 // indirect
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
+	github.com/prometheus/common v0.0.0-20181020173914-7e9e6cabbd39
 	github.com/prometheus/procfs v0.0.0-20181005140218-185b4288413d // indirect
 	golang.org/x/sync v0.0.0-20181108010431-42b317875d0f // indirect
 )
 
-require github.com/mmcloughlin/geohash v0.10.0 // indirect
+require github.com/mmcloughlin/geohash v0.10.0
+
+require (
+	github.com/oschwald/maxminddb-golang v1.10.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.0.0-20220804214406-8e32c043e418 // indirect
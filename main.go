@@ -14,43 +14,389 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/notfromstatefarm/openvpn_exporter/exporters"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var (
 		listenAddress      = flag.String("web.listen-address", ":9176", "Address to listen on for web interface and telemetry.")
 		metricsPath        = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		openvpnStatusPath = flag.String("openvpn.status_path", "/var/log/openvpn/openvpn-status.log", "Paths at which OpenVPN places its status files.")
+		tlsCertFile        = flag.String("web.tls-cert-file", "", "Path to a PEM encoded certificate to serve HTTPS with.")
+		tlsKeyFile         = flag.String("web.tls-key-file", "", "Path to the PEM encoded key of the certificate given by -web.tls-cert-file.")
+		shutdownTimeout    = flag.Duration("web.shutdown-timeout", 30*time.Second, "Time given to scrapes in progress to finish on SIGINT or SIGTERM.")
+		bearerTokenFile    = flag.String("web.bearer-token-file", "", "Path to a file holding a token that requests for metrics must carry in a bearer Authorization header.")
+		openvpnStatusPaths = flag.String("openvpn.status_paths", "/var/log/openvpn/openvpn-status.log", "Comma separated paths at which OpenVPN places its status files, each optionally prefixed by a name=, which is exported as the server_name label.")
+		openvpnManagement  = flag.String("openvpn.management", "", "Comma separated host:port addresses of OpenVPN management interfaces to query on every scrape, or paths of their unix domain sockets, each optionally prefixed by a name=. Replaces the default status path.")
+		configFile         = flag.String("config.file", "", "Path of a YAML file listing the servers to collect, each with a name, status path or management address, and optional location and extra labels. Replaces the status path, management and discovery flags.")
+		discoverConfigs    = flag.String("openvpn.discover-configs", "", "Glob pattern of OpenVPN configuration files, such as /etc/openvpn/server/*.conf, whose status files are collected, each named after its configuration file. Replaces the default status path.")
+		managementPassword = flag.String("openvpn.management-password", "", "Password of management interfaces whose URL doesn't include one. Visible to other users in the process list; prefer -openvpn.management-password-file or the OPENVPN_MANAGEMENT_PASSWORD environment variable.")
+		managementPwFile   = flag.String("openvpn.management-password-file", "", "Path to a file holding the password of management interfaces whose URL doesn't include one, such as the file passed to OpenVPN's management directive.")
+		bytecountInterval  = flag.Duration("openvpn.management-bytecount-interval", 0, "Interval at which management interfaces notify the byte counts of every client, from which their bandwidth is exported. Zero disables the notifications.")
+		socketMode         = flag.String("openvpn.management-socket-mode", "", "Octal permission bits that management interface sockets may have at most, such as 0660, checked before connecting. Empty disables the check.")
+		sshIdentityFile    = flag.String("ssh.identity-file", "", "Private key authenticating to the hosts of ssh:// status paths. Defaults to the keys configured for the user running the exporter.")
+		statusTokenFile    = flag.String("status.bearer-token-file", "", "Path to a file holding a token sent in a bearer Authorization header when fetching http:// and https:// status paths.")
+		cacheUnchanged     = flag.Bool("status.cache-unchanged", false, "Only parse the status file when its modification time or size changed, exporting the previous metrics otherwise.")
+		requireEnd         = flag.Bool("status.require-end", false, "Report the scrape as failed when the status file lacks the END footer.")
+		sourceTimeout      = flag.Duration("status.timeout", 0, "Time after which collecting a status source is given up on and reported as failed, even when reading it hangs. Zero disables the timeout.")
+		concurrency        = flag.Int("status.concurrency", 8, "Maximum number of status sources collected at once.")
+		statusFormat       = flag.String("status.format", "", "Format of the status file: v1, v2 or v3 for server statuses, or client for client statistics. Detected from the first line by default.")
+		staleAfter         = flag.Duration("status.stale-after", 0, "Report the scrape as failed when the status was last updated longer ago than this. Zero disables the check.")
+		includeUndef       = flag.Bool("status.include-undef", false, "Export clients whose common name is UNDEF or empty, identified by their real address.")
+		noGeoIP            = flag.Bool("no-geoip", false, "Disable all GeoIP lookups, leaving geo labels empty.")
+		geoIPMode          = flag.String("geoip", "all", "Which locations to resolve: all, server-only to leave client geo labels empty, or none like -no-geoip.")
+		geoExcludeCIDRs    = flag.String("geoip.exclude-cidrs", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,::1/128,fc00::/7,fe80::/10", "Comma separated address ranges of clients that are never resolved, as GeoIP APIs can't locate them.")
+		geoMinBytes        = flag.Uint64("geo.min-bytes", 0, "Only resolve GeoIP data for clients that transferred more than this many bytes.")
+		geoIPAsync         = flag.Bool("geoip.async", false, "Resolve clients in the background instead of during scrapes, exporting them without geo labels until resolved.")
+		geoIPTimeout       = flag.Duration("geoip.timeout", 5*time.Second, "Timeout of a single GeoIP lookup.")
+		geoIPProviders     = flag.String("geoip.provider", "ip-api", "Comma separated GeoIP providers tried in order: ip-api, ipinfo for ipinfo.io, ipstack for ipstack.com, mmdb for -geoip.mmdb-file, static for -geoip.static-file, or none.")
+		geoIPToken         = flag.String("geoip.token", "", "Token of GeoIP APIs that require one, such as ipinfo.io, ipstack.com's access key or the key of ip-api.com's pro endpoint. Defaults to the GEOIP_TOKEN environment variable.")
+		geoIPDatabase      = flag.String("geoip.mmdb-file", "", "Path of a MaxMind DB file, such as GeoLite2 City, used by the mmdb GeoIP provider.")
+		geoIPStaticFile    = flag.String("geoip.static-file", "", "Path of a JSON file listing the locations of address ranges, used by the static GeoIP provider.")
+		geoIPURL           = flag.String("geoip.url", "http://ip-api.com/json/{ip}", "URL of the GeoIP API, in which {ip} is replaced by the address to look up and {key} by -geoip.token.")
+		geoIPFields        = flag.String("geoip.fields", "", "Comma separated field=name pairs naming the GeoIP API's response fields holding the ip, country, region, city, lat and lon, or coordinates holding both as \"lat,lon\". Defaults to ip-api.com's names.")
+		geoIPRateLimit     = flag.Float64("geoip.rate-limit", 0, "Maximum number of GeoIP lookups per minute. Negative values disable rate limiting. Defaults to 45, or no limit with ip-api.com's pro endpoint.")
+		geoIPRetries       = flag.Int("geoip.retries", 2, "Number of times a GeoIP request failing with a network error, a server error or rate limiting is retried. Negative values disable retries.")
+		geoIPRetryBackoff  = flag.Duration("geoip.retry-backoff", 500*time.Millisecond, "Delay before the first retry of a GeoIP request, doubling with every further retry.")
+		serverAddress      = flag.String("geoip.server-address", "", "Public IP or hostname of the server, whose location is exported. Defaults to the address the GeoIP API sees the exporter connect from.")
+		serverGeoRefresh   = flag.Duration("geoip.server-refresh-interval", time.Hour, "Interval at which the server's own location is looked up again. Zero disables refreshing.")
+		noDistance         = flag.Bool("geoip.no-distance", false, "Omit the client distance metric.")
+		distanceUnit       = flag.String("geoip.distance-unit", "meters", "Unit of the client distance metric: meters, kilometers or miles.")
+		geoCacheFile       = flag.String("geoip.cache-file", "", "Path of a JSON file persisting resolved client locations across restarts. Empty keeps them in memory only.")
+		geoCacheTTL        = flag.Duration("geoip.cache-ttl", 7*24*time.Hour, "Age after which cached client locations, including those persisted in -geoip.cache-file, are looked up again.")
+		geoCacheSize       = flag.Int("geoip.cache-size", 10000, "Maximum number of cached client locations, beyond which the least recently used one is evicted. Negative values disable the limit.")
+		geohashPrecision   = flag.Int("geoip.geohash-precision", 5, "Number of characters of the server and client geohash labels, from 1 to 12.")
+		clientCoordinates  = flag.Bool("geoip.client-coordinates", false, "Export the latitude and longitude of every resolved client.")
+		maxClientSeries    = flag.Int("max-client-series", 0, "Omit all per-client metrics when the status lists more clients than this. Zero disables the limit.")
+		clientRates        = flag.Bool("client.rates", false, "Export the throughput of every client, computed between consecutive scrapes.")
+		clientLifetime     = flag.Bool("client.lifetime-totals", false, "Export the bytes received and sent by every common name over all of its sessions. Retains the totals of every common name seen until the exporter restarts.")
+		dropLabels         = flag.String("label.drop", "", "Comma separated identifying client labels to omit: common_name, username, real_address.")
+		hashLabels         = flag.String("label.hash", "", "Comma separated identifying client labels to replace by a salted hash: common_name, username, real_address.")
+		includeLabels      = flag.String("label.include", "", "Comma separated client labels to export, omitting all others: common_name, connection_time, real_address, virtual_address, virtual_ipv6_address, username, client_id, peer_id, data_channel_cipher, geohash, city, country, region. Defaults to all but data_channel_cipher.")
+		labelHashSalt      = flag.String("label.hash-salt", "", "Salt of the hashes of labels listed in -label.hash.")
+		logLevel           = flag.String("log.level", "info", "Only log messages with the given severity or above: debug, info, warn or error.")
+		once               = flag.Bool("once", false, "Collect the status once, as a scrape would, print the metrics and exit. Reads the status from standard input unless status paths are given.")
+		validate           = flag.Bool("validate", false, "Print the metrics of the status file once, without GeoIP lookups, and exit. Fails on malformed status files.")
+		showVersion        = flag.Bool("version", false, "Print version information and exit.")
+		serverName         = flag.String("openvpn.server_name", "", "Name identifying a single status source in the server_name label. Defaults to the status path.")
+		namespace          = flag.String("metrics.namespace", "openvpn", "Namespace prefixing the name of every metric.")
+		subsystem          = flag.String("metrics.subsystem", "", "Subsystem inserted after the namespace in the name of every metric.")
 	)
+	// The former name of -openvpn.status_paths.
+	flag.StringVar(openvpnStatusPaths, "openvpn.status_path", *openvpnStatusPaths, "Alias of -openvpn.status_paths.")
 	flag.Parse()
+	var err error
+	if *showVersion {
+		fmt.Println(version.Print("openvpn_exporter"))
+		return
+	}
+	// The default status path is only collected when no management
+	// interface or configuration files are given.
+	statusPathsSet := false
+	flag.Visit(func(f *flag.Flag) {
+		statusPathsSet = statusPathsSet || f.Name == "openvpn.status_paths" || f.Name == "openvpn.status_path"
+	})
+	if *once && !statusPathsSet && *openvpnManagement == "" && *discoverConfigs == "" && *configFile == "" {
+		*openvpnStatusPaths = "-"
+	}
+	// Loads the status sources, again on every reload, as the
+	// configuration file or the status directives of OpenVPN's
+	// configuration files may have changed.
+	loadSources := func() ([]exporters.StatusSource, error) {
+		if *configFile != "" {
+			if statusPathsSet || *openvpnManagement != "" || *discoverConfigs != "" || *serverName != "" {
+				return nil, errors.New("-config.file can't be combined with status paths, management interfaces, discovered configuration files or -openvpn.server_name")
+			}
+			return exporters.LoadConfig(*configFile)
+		}
+		var sources []exporters.StatusSource
+		if (*openvpnManagement == "" && *discoverConfigs == "") || statusPathsSet {
+			var err error
+			sources, err = parseStatusSources(*openvpnStatusPaths)
+			if err != nil {
+				return nil, err
+			}
+		}
+		managementSources, err := parseStatusSources(*openvpnManagement)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range managementSources {
+			if strings.HasPrefix(source.Path, "/") {
+				source.Path = "unix://" + source.Path
+			} else {
+				source.Path = "tcp://" + source.Path
+			}
+			sources = append(sources, source)
+		}
+		if *discoverConfigs != "" {
+			discovered, err := exporters.DiscoverStatusSources(*discoverConfigs)
+			if err != nil {
+				return nil, fmt.Errorf("error discovering status files: %v", err)
+			}
+			sources = append(sources, discovered...)
+		}
+		if len(sources) == 0 {
+			return nil, errors.New("no status paths, management interfaces or configuration files with a status directive given")
+		}
+		if *serverName != "" {
+			if len(sources) > 1 {
+				return nil, errors.New("-openvpn.server_name requires a single status path; name multiple paths as name=path instead")
+			}
+			sources[0].Name = *serverName
+		}
+		return sources, nil
+	}
+	sources, err := loadSources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, source := range sources {
+		// Standard input can only be read once, so it is collected once.
+		if source.Path == "-" {
+			if len(sources) > 1 {
+				log.Fatal("Standard input can't be combined with other status paths")
+			}
+			*validate = !*once
+		}
+	}
+
+	level, err := exporters.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !*validate && !*once {
+		log.Printf("Starting OpenVPN Exporter %s\n", version.Info())
+		log.Printf("Listen address: %v\n", *listenAddress)
+		log.Printf("Metrics path: %v\n", *metricsPath)
+		for _, source := range sources {
+			log.Printf("Status source: %v\n", source.Path)
+		}
+	}
+
+	labelModes := map[string]exporters.LabelMode{}
+	for _, name := range splitList(*dropLabels) {
+		labelModes[name] = exporters.LabelDrop
+	}
+	for _, name := range splitList(*hashLabels) {
+		labelModes[name] = exporters.LabelHash
+	}
+
+	var clientLabels []string
+	if *includeLabels != "" {
+		clientLabels = splitList(*includeLabels)
+	}
+
+	fields := map[string]string{}
+	for _, pair := range splitList(*geoIPFields) {
+		field, name := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			field, name = pair[:i], pair[i+1:]
+		}
+		if name == "" {
+			log.Fatalf("Invalid GeoIP field mapping: %q", pair)
+		}
+		fields[field] = name
+	}
+
+	var managementSocketMode os.FileMode
+	if *socketMode != "" {
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			log.Fatalf("Invalid management socket mode: %q", *socketMode)
+		}
+		managementSocketMode = os.FileMode(mode)
+	}
+
+	password := *managementPassword
+	if password == "" && *managementPwFile != "" {
+		// OpenVPN reads the password from the first line.
+		content, err := ioutil.ReadFile(*managementPwFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		password = strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+	}
+	if password == "" {
+		password = os.Getenv("OPENVPN_MANAGEMENT_PASSWORD")
+	}
+
+	statusBearerToken := ""
+	if *statusTokenFile != "" {
+		token, err := ioutil.ReadFile(*statusTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statusBearerToken = strings.TrimSpace(string(token))
+	}
 
-	log.Printf("Starting OpenVPN Exporter\n")
-	log.Printf("Listen address: %v\n", *listenAddress)
-	log.Printf("Metrics path: %v\n", *metricsPath)
-	log.Printf("openvpn.status_path: %v\n", *openvpnStatusPath)
+	geoToken := *geoIPToken
+	if geoToken == "" {
+		geoToken = os.Getenv("GEOIP_TOKEN")
+	}
 
-	exporter, err := exporters.NewOpenVPNExporter(*openvpnStatusPath)
+	switch *geoIPMode {
+	case "all", "server-only", "none":
+	default:
+		log.Fatalf("Invalid GeoIP mode: %q", *geoIPMode)
+	}
+
+	geoExcludedPrefixes := []netip.Prefix{}
+	for _, cidr := range splitList(*geoExcludeCIDRs) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Fatalf("Invalid GeoIP excluded range: %v", err)
+		}
+		geoExcludedPrefixes = append(geoExcludedPrefixes, prefix)
+	}
+
+	exporter, err := exporters.NewMultiOpenVPNExporter(sources, exporters.Options{
+		RequireEnd:                  *requireEnd,
+		StaleAfter:                  *staleAfter,
+		SourceConcurrency:           *concurrency,
+		SourceTimeout:               *sourceTimeout,
+		StatusFormat:                *statusFormat,
+		CacheUnchangedStatus:        *cacheUnchanged,
+		ManagementSocketMode:        managementSocketMode,
+		ManagementPassword:          password,
+		ManagementBytecountInterval: *bytecountInterval,
+		SSHIdentityFile:             *sshIdentityFile,
+		StatusBearerToken:           statusBearerToken,
+		IncludeUndef:                *includeUndef,
+		DisableGeoIP:                *noGeoIP || *geoIPMode == "none" || *validate,
+		ServerGeoIPOnly:             *geoIPMode == "server-only",
+		GeoMinBytes:                 *geoMinBytes,
+		GeoIPExcludedPrefixes:       geoExcludedPrefixes,
+		AsyncGeoIP:                  *geoIPAsync,
+		GeoIPTimeout:                *geoIPTimeout,
+		GeoIPProviders:              splitList(*geoIPProviders),
+		GeoIPToken:                  geoToken,
+		GeoIPDatabase:               *geoIPDatabase,
+		GeoIPStaticFile:             *geoIPStaticFile,
+		GeoIPURL:                    *geoIPURL,
+		GeoIPFields:                 fields,
+		GeoIPRateLimit:              *geoIPRateLimit,
+		GeoIPRetries:                *geoIPRetries,
+		GeoIPRetryBackoff:           *geoIPRetryBackoff,
+		ServerAddress:               *serverAddress,
+		ServerGeoRefreshInterval:    *serverGeoRefresh,
+		DisableDistance:             *noDistance,
+		DistanceUnit:                *distanceUnit,
+		ClientCoordinates:           *clientCoordinates,
+		GeohashPrecision:            *geohashPrecision,
+		GeoCacheFile:                *geoCacheFile,
+		GeoCacheTTL:                 *geoCacheTTL,
+		GeoCacheSize:                *geoCacheSize,
+		ClientRates:                 *clientRates,
+		ClientLifetimeTotals:        *clientLifetime,
+		MaxClientSeries:             *maxClientSeries,
+		LabelModes:                  labelModes,
+		ClientLabels:                clientLabels,
+		LabelHashSalt:               *labelHashSalt,
+		Logger:                      exporters.StdLogger{Logger: log.Default(), Level: level},
+		Namespace:                   *namespace,
+		Subsystem:                   *subsystem,
+	})
 	if err != nil {
 		panic(err)
 	}
-	prometheus.MustRegister(exporter)
-
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`
-			<html>
-			<head><title>OpenVPN Exporter</title></head>
-			<body>
-			<h1>OpenVPN Exporter</h1>
-			<p><a href='` + *metricsPath + `'>Metrics</a></p>
-			</body>
-			</html>`))
-	})
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	if *once {
+		err := exporter.CollectOnce(os.Stdout)
+		exporter.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *validate {
+		failed := false
+		for _, source := range sources {
+			if err := exporter.Validate(source.Path, os.Stdout); err != nil {
+				log.Printf("%s: %v", source.Path, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	reload := func() error {
+		sources, err := loadSources()
+		if err != nil {
+			return err
+		}
+		if err := exporter.SetStatusSources(sources); err != nil {
+			return err
+		}
+		log.Printf("Reloaded %d status sources\n", len(sources))
+		return nil
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := reload(); err != nil {
+				log.Printf("Error reloading status sources: %v", err)
+			}
+		}
+	}()
+	web := exporters.WebOptions{TLSCertFile: *tlsCertFile, TLSKeyFile: *tlsKeyFile, ShutdownTimeout: *shutdownTimeout, Reload: reload}
+	if *bearerTokenFile != "" {
+		token, err := ioutil.ReadFile(*bearerTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		web.BearerToken = strings.TrimSpace(string(token))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := exporter.ServeContext(ctx, *listenAddress, *metricsPath, web); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Shut down")
+}
+
+// Splits a comma separated flag value, ignoring empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
+
+// Parses the comma separated status paths, each of which may be prefixed
+// by a name and an equals sign.
+func parseStatusSources(value string) ([]exporters.StatusSource, error) {
+	var sources []exporters.StatusSource
+	for _, element := range splitList(value) {
+		source := exporters.StatusSource{Path: element}
+		// Names can't contain the slashes and colons of paths and URLs,
+		// which may themselves contain equals signs.
+		if i := strings.Index(element, "="); i >= 0 && !strings.ContainsAny(element[:i], "/:") {
+			source.Name, source.Path = element[:i], element[i+1:]
+			if source.Name == "" || source.Path == "" {
+				return nil, fmt.Errorf("invalid status path: %q", element)
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
 }